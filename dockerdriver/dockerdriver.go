@@ -0,0 +1,302 @@
+// Package dockerdriver talks to the Docker Engine API to
+// create, inspect, and kill the containers that muniverse
+// uses to sandbox Chrome.
+//
+// It exists so that muniverse does not need the `docker`
+// CLI binary on $PATH: everything goes over the same
+// socket/HTTP connection that the CLI itself uses.
+package dockerdriver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	dockerimage "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/unixpickle/essentials"
+)
+
+// occasionalDockerErr is a transient error the Docker daemon
+// itself returns for some container operations; it is not
+// specific to any one API call, so it can show up from
+// ContainerCreate or ContainerStart alike. It is a plain 500
+// Internal Server Error, not a 409 Conflict, so it has no
+// dedicated client.IsErrXxx helper to match on.
+const occasionalDockerErr = "device or resource busy"
+
+func isRetryable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), occasionalDockerErr)
+}
+
+// RunSpec describes the container that should be created
+// for a new environment.
+type RunSpec struct {
+	// Image is the Docker image to run.
+	Image string
+
+	// Volume, if non-empty, is a host directory to bind
+	// mount to /downloaded_games inside the container.
+	Volume string
+
+	// VolumeMode controls how Volume is mounted, e.g. the
+	// "ro", "z", or "Z" suffixes accepted by Docker.
+	// It may be empty for the default read/write mount.
+	VolumeMode string
+
+	// ExtraVolumes are additional host:container bind
+	// mounts (with an optional :mode suffix) to attach.
+	ExtraVolumes []string
+
+	// WindowWidth and WindowHeight are passed to the game
+	// server as the --window-size=W,H argument.
+	WindowWidth, WindowHeight int
+
+	// Resources caps what the container may consume.
+	Resources Resources
+}
+
+// Resources specifies optional resource limits for a
+// container. Zero values mean "no limit", except that a
+// zero ShmSizeBytes leaves /dev/shm at Docker's default size.
+type Resources struct {
+	CPUShares       int64
+	CPUQuota        int64
+	CPUSetCPUs      string
+	MemoryBytes     int64
+	MemorySwapBytes int64
+	PidsLimit       int64
+	ShmSizeBytes    int64
+	GPUs            string
+	SecurityOpts    []string
+}
+
+// A Client drives containers through the Docker Engine
+// API.
+type Client struct {
+	api client.APIClient
+}
+
+// NewClient creates a Client using the same environment
+// variables and defaults as the `docker` CLI
+// (DOCKER_HOST, DOCKER_CERT_PATH, etc.).
+func NewClient() (*Client, error) {
+	return NewClientAt("")
+}
+
+// NewClientAt creates a Client talking to host (e.g.
+// "unix:///run/podman/podman.sock"), or falls back to the
+// same environment-variable defaults as NewClient if host
+// is empty.
+func NewClientAt(host string) (*Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	api, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, essentials.AddCtx("new docker client", err)
+	}
+	return &Client{api: api}, nil
+}
+
+// Run creates and starts a container for spec, pulling the
+// image first if it is not already present.
+//
+// Pull progress is streamed to progress, which may be nil.
+//
+// Run tries create up to 3 times in all while it fails with
+// occasionalDockerErr, mirroring the retry the -tags
+// dockercli fallback does for the same daemon-side error.
+func (c *Client) Run(ctx context.Context, spec *RunSpec, progress io.Writer) (id string, err error) {
+	defer essentials.AddCtxTo("docker run", &err)
+
+	if err := c.pullIfNeeded(ctx, spec.Image, progress); err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		id, err = c.create(ctx, spec)
+		if err == nil || !isRetryable(err) {
+			return id, err
+		}
+	}
+	return id, err
+}
+
+func (c *Client) create(ctx context.Context, spec *RunSpec) (id string, err error) {
+	exposed, bindings, err := portConfig()
+	if err != nil {
+		return "", err
+	}
+
+	mounts, err := bindMounts(spec)
+	if err != nil {
+		return "", err
+	}
+
+	hostConfig := &container.HostConfig{
+		AutoRemove:   true,
+		PortBindings: bindings,
+		Binds:        mounts,
+		Resources: container.Resources{
+			CPUShares:  spec.Resources.CPUShares,
+			CPUQuota:   spec.Resources.CPUQuota,
+			CpusetCpus: spec.Resources.CPUSetCPUs,
+			Memory:     spec.Resources.MemoryBytes,
+			MemorySwap: spec.Resources.MemorySwapBytes,
+			PidsLimit:  &spec.Resources.PidsLimit,
+		},
+		ShmSize:     spec.Resources.ShmSizeBytes,
+		SecurityOpt: spec.Resources.SecurityOpts,
+	}
+	if spec.Resources.GPUs != "" {
+		devs, err := gpuDeviceRequests(spec.Resources.GPUs)
+		if err != nil {
+			return "", err
+		}
+		hostConfig.DeviceRequests = devs
+	}
+
+	windowArg := fmt.Sprintf("--window-size=%d,%d", spec.WindowWidth, spec.WindowHeight)
+	created, err := c.api.ContainerCreate(ctx, &container.Config{
+		Image:        spec.Image,
+		Cmd:          []string{windowArg},
+		ExposedPorts: exposed,
+		AttachStdin:  true,
+		OpenStdin:    true,
+	}, hostConfig, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	if err := c.api.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		// AutoRemove only cleans up a container that exits or
+		// is stopped after running; it does nothing for one
+		// that never successfully started, so remove it
+		// ourselves to avoid leaking it (Run retries create on
+		// occasionalDockerErr, so without this a single flaky sequence
+		// could otherwise leak up to 3 containers).
+		removeErr := c.api.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+		if removeErr != nil {
+			return "", fmt.Errorf("%s (also failed to remove container: %s)", err, removeErr)
+		}
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+// Ports returns the host ports bound to the container's
+// exposed ports, e.g. mapping["9222/tcp"] == "9000".
+func (c *Client) Ports(ctx context.Context, id string) (map[string]string, error) {
+	info, err := c.api.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, essentials.AddCtx("docker inspect", err)
+	}
+	result := map[string]string{}
+	for port, bindings := range info.NetworkSettings.Ports {
+		if len(bindings) != 1 {
+			return nil, essentials.AddCtx("docker inspect",
+				fmt.Errorf("unexpected number of host ports for %s", port))
+		}
+		result[string(port)] = bindings[0].HostPort
+	}
+	return result, nil
+}
+
+// IPAddress returns the container's IP address on the
+// named network (e.g. "bridge" or "nat").
+func (c *Client) IPAddress(ctx context.Context, id, network string) (string, error) {
+	info, err := c.api.ContainerInspect(ctx, id)
+	if err != nil {
+		return "", essentials.AddCtx("docker inspect", err)
+	}
+	net, ok := info.NetworkSettings.Networks[network]
+	if !ok || net.IPAddress == "" {
+		return "", fmt.Errorf("docker inspect: no address on network %q", network)
+	}
+	return net.IPAddress, nil
+}
+
+// Kill sends SIGKILL to the container.
+func (c *Client) Kill(ctx context.Context, id string) error {
+	if err := c.api.ContainerKill(ctx, id, "KILL"); err != nil {
+		return essentials.AddCtx("docker kill", err)
+	}
+	return nil
+}
+
+// Close releases the underlying API connection.
+func (c *Client) Close() error {
+	return c.api.Close()
+}
+
+// EnsureImage pulls image if it is not already present
+// locally. Callers that are about to create many
+// containers from the same image should call this once up
+// front so the containers don't race each other to pull it.
+func (c *Client) EnsureImage(ctx context.Context, image string, progress io.Writer) error {
+	return c.pullIfNeeded(ctx, image, progress)
+}
+
+func (c *Client) pullIfNeeded(ctx context.Context, image string, progress io.Writer) error {
+	_, _, err := c.api.ImageInspectWithRaw(ctx, image)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+	rc, err := c.api.ImagePull(ctx, image, dockerimage.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if progress != nil {
+		_, err = io.Copy(progress, rc)
+	} else {
+		_, err = io.Copy(ioutil.Discard, rc)
+	}
+	return err
+}
+
+// portRange is the fixed host port range 9222/1337 are bound
+// within, matching the -tags dockercli fallback's `-p
+// 9000-9999:...` flags, so that users relying on a fixed
+// range (firewall rules, NAT port-forwarding for a training
+// cluster) get the same guarantee from either backend
+// instead of an arbitrary ephemeral port.
+const portRange = "9000-9999"
+
+func portConfig() (nat.PortSet, nat.PortMap, error) {
+	ports := []string{"9222/tcp", "1337/tcp"}
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, p := range ports {
+		port, err := nat.NewPort("tcp", p[:len(p)-len("/tcp")])
+		if err != nil {
+			return nil, nil, err
+		}
+		exposed[port] = struct{}{}
+		bindings[port] = []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: portRange}}
+	}
+	return exposed, bindings, nil
+}
+
+func bindMounts(spec *RunSpec) ([]string, error) {
+	var mounts []string
+	if spec.Volume != "" {
+		mount := spec.Volume + ":/downloaded_games"
+		if spec.VolumeMode != "" {
+			mount += ":" + spec.VolumeMode
+		}
+		mounts = append(mounts, mount)
+	}
+	mounts = append(mounts, spec.ExtraVolumes...)
+	return mounts, nil
+}
@@ -0,0 +1,76 @@
+package dockerdriver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+)
+
+func TestIsRetryable(t *testing.T) {
+	if isRetryable(nil) {
+		t.Error("nil error should not be retryable")
+	}
+	if isRetryable(errors.New("some other failure")) {
+		t.Error("unrelated errors should not be retryable")
+	}
+	busy := errors.New("Error response from daemon: device or resource busy.")
+	if !isRetryable(busy) {
+		t.Error("the occasional daemon-side busy error should be retryable")
+	}
+}
+
+func TestPortConfig(t *testing.T) {
+	exposed, bindings, err := portConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, p := range []string{"9222/tcp", "1337/tcp"} {
+		port, err := nat.NewPort("tcp", p[:len(p)-len("/tcp")])
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, ok := exposed[port]; !ok {
+			t.Errorf("expected %s to be exposed", p)
+		}
+		binds, ok := bindings[port]
+		if !ok || len(binds) != 1 {
+			t.Fatalf("expected exactly one binding for %s, got %+v", p, binds)
+		}
+		if binds[0].HostPort != portRange {
+			t.Errorf("expected %s bound to %s, got %s", p, portRange, binds[0].HostPort)
+		}
+	}
+}
+
+func TestBindMounts(t *testing.T) {
+	tests := []struct {
+		name string
+		spec *RunSpec
+		want []string
+	}{
+		{"no volume", &RunSpec{}, nil},
+		{"volume without mode", &RunSpec{Volume: "/host/games"},
+			[]string{"/host/games:/downloaded_games"}},
+		{"volume with mode", &RunSpec{Volume: "/host/games", VolumeMode: "ro,Z"},
+			[]string{"/host/games:/downloaded_games:ro,Z"}},
+		{"extra volumes appended", &RunSpec{
+			Volume:       "/host/games",
+			ExtraVolumes: []string{"/host/extra:/container/extra"},
+		}, []string{"/host/games:/downloaded_games", "/host/extra:/container/extra"}},
+	}
+	for _, test := range tests {
+		mounts, err := bindMounts(test.spec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err)
+		}
+		if len(mounts) != len(test.want) {
+			t.Fatalf("%s: expected %v but got %v", test.name, test.want, mounts)
+		}
+		for i, m := range mounts {
+			if m != test.want[i] {
+				t.Errorf("%s: expected %v but got %v", test.name, test.want, mounts)
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package dockerdriver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// gpuDeviceRequests translates a --gpus style string (e.g.
+// "all" or "2") into the DeviceRequests the Engine API
+// expects for the nvidia runtime.
+func gpuDeviceRequests(gpus string) ([]container.DeviceRequest, error) {
+	req := container.DeviceRequest{
+		Driver:       "nvidia",
+		Capabilities: [][]string{{"gpu"}},
+	}
+	if gpus == "all" {
+		req.Count = -1
+	} else {
+		count, err := strconv.Atoi(gpus)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GPUs value: %s", gpus)
+		}
+		req.Count = count
+	}
+	return []container.DeviceRequest{req}, nil
+}
@@ -0,0 +1,25 @@
+package dockerdriver
+
+import "testing"
+
+func TestGPUDeviceRequests(t *testing.T) {
+	devs, err := gpuDeviceRequests("all")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(devs) != 1 || devs[0].Count != -1 {
+		t.Errorf("expected a single request with Count -1, got %+v", devs)
+	}
+
+	devs, err = gpuDeviceRequests("2")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(devs) != 1 || devs[0].Count != 2 {
+		t.Errorf("expected a single request with Count 2, got %+v", devs)
+	}
+
+	if _, err := gpuDeviceRequests("not-a-number"); err == nil {
+		t.Error("expected an error for a non-numeric GPUs value")
+	}
+}
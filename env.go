@@ -2,23 +2,20 @@ package muniverse
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
-	"os/exec"
-	"runtime"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/muniverse/chrome"
+	"github.com/unixpickle/muniverse/metrics"
+	"github.com/unixpickle/muniverse/runtime"
 )
 
 const (
-	portRange    = "9000-9999"
 	defaultImage = "unixpickle/muniverse:0.107.0"
 )
 
@@ -27,10 +24,6 @@ const (
 	chromeConnectAttempts = 20
 )
 
-// This error message occurs very infrequently when doing
-// `docker run` on my machine running Ubuntu 16.04.1.
-const occasionalDockerErr = "Error response from daemon: device or resource busy."
-
 // An Env controls and observes an environment.
 //
 // It is not safe to run an methods on an Env from more
@@ -60,7 +53,9 @@ type Env interface {
 	//
 	// If done is true, then the episode has ended.
 	// After an episode ends, Reset must be called once
-	// before Step may be called again.
+	// before Step may be called again; calling Step again
+	// without a Reset returns an error for which
+	// IsNeedsReset is true, rather than doing nothing.
 	// However, observations may be made even after the
 	// episode has ended.
 	//
@@ -88,13 +83,26 @@ type Env interface {
 	Log() []string
 }
 
+// ErrNeedsReset is the error Step returns once an episode has
+// ended, for as long as Reset has not yet been called.
+var ErrNeedsReset = errors.New("environment needs reset")
+
+// IsNeedsReset reports whether err is (or wraps, including
+// through the essentials.AddCtx/CtxError chain Step's callers
+// use) ErrNeedsReset, as opposed to a genuine Step failure such
+// as a crashed container.
+func IsNeedsReset(err error) bool {
+	return errors.Is(err, ErrNeedsReset)
+}
+
 type rawEnv struct {
 	spec     EnvSpec
 	gameHost string
 
-	containerID string
-	devConn     *chrome.Conn
-	lastScore   float64
+	containerID      string
+	containerRuntime runtime.Runtime
+	devConn          *chrome.Conn
+	lastScore        float64
 
 	needsReset         bool
 	hasNavigatedBefore bool
@@ -105,6 +113,18 @@ type rawEnv struct {
 	// Used to garbage collect the container if we
 	// exit ungracefully.
 	killSocket net.Conn
+
+	metrics       *metrics.Set
+	episodeReward float64
+	episodeSteps  int
+}
+
+// metricLabels returns this env's Prometheus labels.
+//
+// container_id is deliberately not a label; see the doc
+// comment on metrics.Set.
+func (r *rawEnv) metricLabels() prometheus.Labels {
+	return prometheus.Labels{"env": r.spec.Name}
 }
 
 // Options specifies how to configure a new Env.
@@ -131,6 +151,18 @@ type Options struct {
 	// downloaded_games folder.
 	GamesDir string
 
+	// GamesDirMode controls how GamesDir is bind mounted,
+	// e.g. to relabel it for SELinux-enforcing hosts.
+	// The zero value, MountNone, preserves the historical
+	// behavior of a plain read/write bind mount.
+	GamesDirMode GamesDirMode
+
+	// ExtraVolumes are additional "host:container[:opts]"
+	// bind mounts, using the same syntax as `docker run -v`,
+	// for users who need to ship extra assets alongside
+	// GamesDir.
+	ExtraVolumes []string
+
 	// DevtoolsHost, if non-empty, specifies the host of
 	// an already-running Chrome's DevTools server.
 	//
@@ -156,6 +188,121 @@ type Options struct {
 	// observations if Compression is set.
 	// The value ranges from 0 to 100 (inclusive).
 	CompressionQuality int
+
+	// CPUShares sets the relative CPU weight of the
+	// container, as in `docker run --cpu-shares`.
+	// Zero means unset.
+	CPUShares int64
+
+	// CPUQuota caps CPU time in microseconds per 100ms
+	// period, as in `docker run --cpu-quota`.
+	// Zero means unset.
+	CPUQuota int64
+
+	// CPUSetCPUs pins the container to specific CPUs, as
+	// in `docker run --cpuset-cpus`, e.g. "0-3" or "0,2".
+	CPUSetCPUs string
+
+	// MemoryBytes caps the container's memory, as in
+	// `docker run --memory`. Zero means unset.
+	MemoryBytes int64
+
+	// MemorySwapBytes caps the container's memory plus
+	// swap, as in `docker run --memory-swap`. If set, it
+	// must be at least MemoryBytes. Zero means unset.
+	MemorySwapBytes int64
+
+	// PidsLimit caps the number of processes/threads the
+	// container may create, as in `docker run --pids-limit`.
+	// Zero means unset.
+	PidsLimit int64
+
+	// ShmSizeBytes sets the size of /dev/shm, as in
+	// `docker run --shm-size`. If zero, it defaults to
+	// 200 MiB, which is what Chrome needs to avoid
+	// crashing on large pages.
+	ShmSizeBytes int64
+
+	// GPUs requests GPU access, as in `docker run --gpus`,
+	// e.g. "all" or "2". Empty means no GPU access.
+	GPUs string
+
+	// SecurityOpts are passed through as one or more
+	// `docker run --security-opt` flags, e.g. to select a
+	// custom seccomp profile.
+	SecurityOpts []string
+
+	// Record, if non-nil, causes the returned Env to record
+	// each episode to a video and a JSONL trace file. It
+	// requires importing muniverse/record for its side
+	// effect of calling RegisterRecorder; see RecordConfig.
+	Record *RecordConfig
+
+	// MetricsRegisterer, if non-nil, causes Step, Reset,
+	// Observe, and the Docker plumbing to record labeled
+	// metrics (see muniverse/metrics) to it. The same
+	// Registerer can be reused across many NewEnvOptions
+	// calls; muniverse registers each metric only once.
+	MetricsRegisterer prometheus.Registerer
+
+	// Runtime selects which container engine backend runs
+	// the environment's container. The zero value,
+	// RuntimeDocker, talks to Docker (or a Docker-Engine-API-
+	// compatible daemon such as Podman, when combined with
+	// RuntimeSocket or RuntimePodman).
+	//
+	// Runtime is ignored when DevtoolsHost is set.
+	Runtime RuntimeKind
+
+	// RuntimeSocket, if non-empty, overrides the default
+	// socket/host for Runtime, e.g.
+	// "/run/containerd/containerd.sock" or
+	// "unix:///run/podman/podman.sock". An empty value uses
+	// the backend's usual default (DOCKER_HOST for
+	// RuntimeDocker/RuntimePodman, /run/containerd/containerd.sock
+	// for RuntimeContainerd).
+	RuntimeSocket string
+}
+
+// RuntimeKind selects a muniverse/runtime backend.
+type RuntimeKind = runtime.Kind
+
+const (
+	// RuntimeDocker talks to a Docker Engine API socket.
+	// This is the default.
+	RuntimeDocker = runtime.Docker
+
+	// RuntimeContainerd talks directly to a containerd
+	// socket, bypassing Docker entirely.
+	RuntimeContainerd = runtime.Containerd
+
+	// RuntimePodman talks to a Podman socket using the same
+	// client as RuntimeDocker, since Podman exposes a
+	// Docker-Engine-API-compatible socket when run with
+	// `podman system service`.
+	RuntimePodman = runtime.Podman
+)
+
+// validate checks for resource settings that Docker itself
+// would reject or that otherwise make no sense together.
+func (o *Options) validate() error {
+	if o.MemorySwapBytes != 0 && o.MemoryBytes != 0 && o.MemorySwapBytes < o.MemoryBytes {
+		return errors.New("MemorySwapBytes must be at least MemoryBytes")
+	}
+	if o.MemorySwapBytes != 0 && o.MemoryBytes == 0 {
+		return errors.New("MemorySwapBytes requires MemoryBytes to be set")
+	}
+	if o.GamesDir != "" {
+		if err := validateHostPath(o.GamesDir); err != nil {
+			return err
+		}
+	}
+	for _, vol := range o.ExtraVolumes {
+		if err := validateExtraVolume(vol); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // NewEnv creates a new environment inside the default
@@ -170,16 +317,50 @@ func NewEnv(spec *EnvSpec) (Env, error) {
 	return NewEnvOptions(spec, &Options{})
 }
 
+// PrewarmImage pulls the Docker image that opts would use
+// for NewEnvOptions, if it is not already present locally.
+//
+// Callers that are about to create many environments from
+// the same Options (e.g. muniverse/vec) should call this
+// once up front, so that the containers don't all race each
+// other to pull the image the first time they start.
+//
+// PrewarmImage is a no-op if opts.DevtoolsHost is set, since
+// no Docker image is used in that case.
+func PrewarmImage(opts *Options) (err error) {
+	defer essentials.AddCtxTo("prewarm image", &err)
+	if opts.DevtoolsHost != "" {
+		return nil
+	}
+	image := opts.CustomImage
+	if image == "" {
+		image = defaultImage
+	}
+	rt, err := runtime.New(opts.Runtime, opts.RuntimeSocket)
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+	ctx, cancel := callCtx()
+	defer cancel()
+	return rt.EnsureImage(ctx, image)
+}
+
 // NewEnvOptions creates a new environment with the given
 // set of options.
 func NewEnvOptions(spec *EnvSpec, opts *Options) (e Env, err error) {
 	defer essentials.AddCtxTo("create environment", &err)
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	ms := metricsFor(opts.MetricsRegisterer)
+
 	var res *rawEnv
 	if opts.DevtoolsHost != "" {
 		if opts.GameHost == "" {
 			return nil, errors.New("must set GameHost with DevtoolsHost")
 		}
-		res, err = newEnvChrome(opts.DevtoolsHost, opts.GameHost, spec)
+		res, err = newEnvChrome(opts.DevtoolsHost, opts.GameHost, spec, ms)
 		if err != nil {
 			return nil, err
 		}
@@ -188,87 +369,127 @@ func NewEnvOptions(spec *EnvSpec, opts *Options) (e Env, err error) {
 		if image == "" {
 			image = defaultImage
 		}
-		res, err = newEnvDocker(image, opts.GamesDir, spec)
+		res, err = newEnvDocker(image, opts.GamesDir, opts, spec, ms)
 		if err != nil {
 			return nil, err
 		}
 	}
 	res.compression = opts.Compression
 	res.compressionQuality = opts.CompressionQuality
-	return res, nil
-}
-
-func newEnvDocker(image, volume string, spec *EnvSpec) (env *rawEnv, err error) {
-	ctx, cancel := callCtx()
-	defer cancel()
 
-	var id string
-
-	fmt.Println("Trying docker run...")
-
-	// Retry as a workaround for an occasional error given
-	// by `docker run`.
-	for i := 0; i < 3; i++ {
-		id, err = dockerRun(ctx, image, volume, spec)
-		if err != nil {
-			fmt.Println("run failed", err)
+	e = res
+	if opts.Record != nil {
+		if recorderHook == nil {
+			return nil, errors.New("Options.Record is set but muniverse/record was not imported")
 		}
-		if err == nil || !strings.Contains(err.Error(), occasionalDockerErr) {
-			break
+		e, err = recorderHook(e, opts.Record)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return e, nil
+}
 
+func newEnvDocker(image, volume string, opts *Options, spec *EnvSpec,
+	ms *metrics.Set) (env *rawEnv, err error) {
+	ctx, cancel := callCtx()
+	defer cancel()
+
+	rt, err := runtime.New(opts.Runtime, opts.RuntimeSocket)
 	if err != nil {
 		return
 	}
 
-	fmt.Println("Getting ports and address...")
+	fmt.Println("Trying docker run...")
 
-	ports, err := dockerBoundPorts(ctx, id)
+	id, err := rt.Create(ctx, &runtime.Spec{
+		Image:        image,
+		Volume:       volume,
+		VolumeMode:   opts.GamesDirMode.dockerVolumeSuffix(),
+		ExtraVolumes: opts.ExtraVolumes,
+		WindowWidth:  spec.Width,
+		WindowHeight: spec.Height,
+		Resources:    resourcesFromOptions(opts),
+	})
 	if err != nil {
+		fmt.Println("run failed", err)
+		rt.Close()
 		return
 	}
 
-	addr, err := dockerIPAddress(ctx, id)
+	fmt.Println("Getting ports and address...")
+
+	info, err := rt.Inspect(ctx, id)
 	if err != nil {
+		rt.Close()
 		return
 	}
 
-	fmt.Println("address is:", addr)
-	fmt.Println("ports are:", ports)
+	fmt.Println("address is:", info.IPAddress)
+	fmt.Println("ports are:", info.Ports)
 
-	conn, err := connectDevTools(ctx, addr+":"+ports["9222/tcp"])
+	connLabels := prometheus.Labels{"env": spec.Name}
+	conn, err := connectDevTools(ctx, info.IPAddress+":"+info.Ports["9222/tcp"], ms, connLabels)
 	if err != nil {
 		fmt.Println("failed to connect to devtools:", err)
+		rt.Close()
 		return
 	}
 
 	fmt.Println("connected to devtools")
 
 	killSock, err := (&net.Dialer{}).DialContext(ctx, "tcp",
-		addr+":"+ports["1337/tcp"])
+		info.IPAddress+":"+info.Ports["1337/tcp"])
 	if err != nil {
 		fmt.Println("failed to connect to kill socket:", err)
 		conn.Close()
+		rt.Close()
 		return
 	}
 
 	fmt.Println("created environment!")
 
 	return &rawEnv{
-		spec:        *spec,
-		gameHost:    "localhost",
-		containerID: id,
-		devConn:     conn,
-		killSocket:  killSock,
+		spec:             *spec,
+		gameHost:         "localhost",
+		containerID:      string(id),
+		containerRuntime: rt,
+		devConn:          conn,
+		killSocket:       killSock,
+		metrics:          ms,
 	}, nil
 }
 
-func newEnvChrome(host, gameHost string, spec *EnvSpec) (*rawEnv, error) {
+// resourcesFromOptions translates opts' resource limits
+// into a runtime.Resources, defaulting ShmSizeBytes to 200
+// MiB since Chrome needs more than Docker's tiny default to
+// avoid crashing on large pages.
+func resourcesFromOptions(opts *Options) runtime.Resources {
+	shmSize := opts.ShmSizeBytes
+	if shmSize == 0 {
+		shmSize = defaultShmSizeBytes
+	}
+	return runtime.Resources{
+		CPUShares:       opts.CPUShares,
+		CPUQuota:        opts.CPUQuota,
+		CPUSetCPUs:      opts.CPUSetCPUs,
+		MemoryBytes:     opts.MemoryBytes,
+		MemorySwapBytes: opts.MemorySwapBytes,
+		PidsLimit:       opts.PidsLimit,
+		ShmSizeBytes:    shmSize,
+		GPUs:            opts.GPUs,
+		SecurityOpts:    opts.SecurityOpts,
+	}
+}
+
+const defaultShmSizeBytes = 200 * 1024 * 1024
+
+func newEnvChrome(host, gameHost string, spec *EnvSpec, ms *metrics.Set) (*rawEnv, error) {
 	ctx, cancel := callCtx()
 	defer cancel()
 
-	conn, err := connectDevTools(ctx, host)
+	labels := prometheus.Labels{"env": spec.Name}
+	conn, err := connectDevTools(ctx, host, ms, labels)
 	if err != nil {
 		return nil, err
 	}
@@ -278,6 +499,7 @@ func newEnvChrome(host, gameHost string, spec *EnvSpec) (*rawEnv, error) {
 		gameHost:   gameHost,
 		devConn:    conn,
 		needsReset: true,
+		metrics:    ms,
 	}, nil
 }
 
@@ -289,6 +511,13 @@ func (r *rawEnv) Spec() *EnvSpec {
 func (r *rawEnv) Reset() (err error) {
 	defer essentials.AddCtxTo("reset environment", &err)
 
+	if r.metrics != nil {
+		start := time.Now()
+		defer func() {
+			r.metrics.ResetDuration.With(r.metricLabels()).Observe(time.Since(start).Seconds())
+		}()
+	}
+
 	ctx, cancel := callCtx()
 	defer cancel()
 
@@ -312,6 +541,9 @@ func (r *rawEnv) Reset() (err error) {
 		return
 	}
 	if is404 {
+		if r.metrics != nil {
+			r.metrics.NotFoundErrors.With(r.metricLabels()).Inc()
+		}
 		return errors.New("likely 404 page (no base game found)")
 	}
 
@@ -326,6 +558,8 @@ func (r *rawEnv) Reset() (err error) {
 
 	if err == nil {
 		r.needsReset = false
+		r.episodeReward = 0
+		r.episodeSteps = 0
 	}
 
 	return
@@ -335,8 +569,15 @@ func (r *rawEnv) Step(t time.Duration, events ...interface{}) (reward float64,
 	done bool, err error) {
 	defer essentials.AddCtxTo("step environment", &err)
 
+	if r.metrics != nil {
+		start := time.Now()
+		defer func() {
+			r.metrics.StepDuration.With(r.metricLabels()).Observe(time.Since(start).Seconds())
+		}()
+	}
+
 	if r.needsReset {
-		err = errors.New("environment needs reset")
+		err = ErrNeedsReset
 		return
 	}
 
@@ -378,12 +619,35 @@ func (r *rawEnv) Step(t time.Duration, events ...interface{}) (reward float64,
 	}
 	reward = r.lastScore - lastScore
 
+	if r.metrics != nil {
+		r.episodeReward += reward
+		r.episodeSteps++
+		if done {
+			labels := r.metricLabels()
+			r.metrics.EpisodeReward.With(labels).Observe(r.episodeReward)
+			r.metrics.EpisodeLength.With(labels).Observe(float64(r.episodeSteps))
+		}
+	}
+
 	return
 }
 
 func (r *rawEnv) Observe() (obs Obs, err error) {
 	defer essentials.AddCtxTo("observe environment", &err)
 
+	if r.metrics != nil {
+		start := time.Now()
+		defer func() {
+			labels := r.metricLabels()
+			r.metrics.ObserveDuration.With(labels).Observe(time.Since(start).Seconds())
+			if err == nil {
+				if n := obsByteLen(obs); n > 0 {
+					r.metrics.ObservationBytes.With(labels).Observe(float64(n))
+				}
+			}
+		}()
+	}
+
 	ctx, cancel := callCtx()
 	defer cancel()
 
@@ -444,8 +708,8 @@ func (r *rawEnv) Close() (err error) {
 		r.devConn.Close(),
 	}
 	if r.containerID != "" {
-		_, e := dockerCommand(ctx, "kill", r.containerID)
-		errs = append(errs, e)
+		errs = append(errs, r.containerRuntime.Kill(ctx, runtime.Handle(r.containerID)))
+		errs = append(errs, r.containerRuntime.Close())
 	}
 
 	if r.killSocket != nil {
@@ -483,6 +747,34 @@ func (r *rawEnv) envURL() string {
 	return "http://" + r.gameHost + "/" + baseName
 }
 
+// EncodedImage returns the raw encoded image bytes behind
+// obs and the format they are encoded in ("png" or "jpeg"),
+// or ok=false if obs is not one of the encoded observation
+// types this package produces (pngObs/jpegObs are
+// unexported, so callers outside this package, such as
+// muniverse/record, have no other way to get at the bytes).
+func EncodedImage(obs Obs) (data []byte, format string, ok bool) {
+	switch v := obs.(type) {
+	case pngObs:
+		return []byte(v), "png", true
+	case jpegObs:
+		return []byte(v), "jpeg", true
+	default:
+		return nil, "", false
+	}
+}
+
+// obsByteLen returns the size of the encoded image behind
+// obs, or 0 if obs is not one of the encoded observation
+// types this package produces.
+func obsByteLen(obs Obs) int {
+	data, _, ok := EncodedImage(obs)
+	if !ok {
+		return 0
+	}
+	return len(data)
+}
+
 func (r *rawEnv) allowKeyCode(code string) bool {
 	for _, c := range r.spec.KeyWhitelist {
 		if c == code {
@@ -496,111 +788,12 @@ func callCtx() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), callTimeout)
 }
 
-func dockerRun(ctx context.Context, container, volume string,
-	spec *EnvSpec) (id string, err error) {
-	args := []string{
-		"run",
-		"-p",
-		portRange + ":9222",
-		"-p",
-		portRange + ":1337",
-		"--shm-size=200m",
-		"-d",   // Run in detached mode.
-		"--rm", // Automatically delete the container.
-		"-i",   // Give netcat a stdin to read from.
-	}
-	if volume != "" {
-		if strings.Contains(volume, ":") {
-			return "", errors.New("path contains colons: " + volume)
-		}
-		args = append(args, "-v", volume+":/downloaded_games")
-	}
-	args = append(args, container,
-		fmt.Sprintf("--window-size=%d,%d", spec.Width, spec.Height))
-
-	output, err := dockerCommand(ctx, args...)
-	if err != nil {
-		return "", essentials.AddCtx("docker run",
-			fmt.Errorf("%s (make sure docker is up-to-date)", err))
-	}
-
-	return strings.TrimSpace(string(output)), nil
-}
-
-func dockerBoundPorts(ctx context.Context,
-	containerID string) (mapping map[string]string, err error) {
-	defer essentials.AddCtxTo("docker inspect", &err)
-	rawJSON, err := dockerCommand(ctx, "inspect", containerID)
-	if err != nil {
-		return nil, err
-	}
-	var info []struct {
-		NetworkSettings struct {
-			Ports map[string][]struct {
-				HostPort string
-			}
-		}
-	}
-	if err := json.Unmarshal(rawJSON, &info); err != nil {
-		return nil, err
-	}
-	if len(info) != 1 {
-		return nil, errors.New("unexpected number of results")
-	}
-	rawMapping := info[0].NetworkSettings.Ports
-	mapping = map[string]string{}
-	for containerPort, hostPorts := range rawMapping {
-		if len(hostPorts) != 1 {
-			return nil, errors.New("unexpected number of host ports")
-		}
-		mapping[containerPort] = hostPorts[0].HostPort
-	}
-	return
-}
-
-func dockerIPAddress(ctx context.Context, containerID string) (addr string, err error) {
-	if runtime.GOOS != "windows" {
-		return "localhost", nil
-	}
-	defer essentials.AddCtxTo("docker inspect", &err)
-	for _, network := range []string{"bridge", "nat"} {
-		ipData, err := dockerCommand(
-			ctx,
-			"inspect",
-			"--format",
-			"{{ .NetworkSettings.Networks."+network+".IPAddress }}",
-			containerID,
-		)
-		if err != nil {
-			return "", err
-		}
-		ipStr := strings.TrimSpace(string(ipData))
-		if ipStr == "<no value>" || ipStr == "" {
-			continue
-		}
-		return ipStr, nil
-	}
-	return "", errors.New("unable to find container IP address")
-}
-
-var dockerLock sync.Mutex
-
-func dockerCommand(ctx context.Context, args ...string) (output []byte, err error) {
-	dockerLock.Lock()
-	defer dockerLock.Unlock()
-	output, err = exec.CommandContext(ctx, "docker", args...).Output()
-	if err != nil {
-		if eo, ok := err.(*exec.ExitError); ok && len(eo.Stderr) > 0 {
-			stderrMsg := strings.TrimSpace(string(eo.Stderr))
-			err = fmt.Errorf("%s: %s", eo.String(), stderrMsg)
-		}
-	}
-	return
-}
-
-func connectDevTools(ctx context.Context, host string) (conn *chrome.Conn,
-	err error) {
+func connectDevTools(ctx context.Context, host string, ms *metrics.Set,
+	labels prometheus.Labels) (conn *chrome.Conn, err error) {
 	for i := 0; i < chromeConnectAttempts; i++ {
+		if i > 0 && ms != nil {
+			ms.DevToolsReconnects.With(labels).Inc()
+		}
 		conn, err = attemptDevTools(ctx, host)
 		if err == nil {
 			return
@@ -0,0 +1,26 @@
+package muniverse
+
+import "testing"
+
+func TestOptionsValidateMemorySwap(t *testing.T) {
+	tests := []struct {
+		name            string
+		memoryBytes     int64
+		memorySwapBytes int64
+		wantErr         bool
+	}{
+		{"neither set", 0, 0, false},
+		{"memory only", 1 << 20, 0, false},
+		{"swap equal to memory", 1 << 20, 1 << 20, false},
+		{"swap greater than memory", 1 << 20, 2 << 20, false},
+		{"swap less than memory", 2 << 20, 1 << 20, true},
+		{"swap without memory", 0, 1 << 20, true},
+	}
+	for _, test := range tests {
+		o := &Options{MemoryBytes: test.memoryBytes, MemorySwapBytes: test.memorySwapBytes}
+		err := o.validate()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: expected error=%v but got %v", test.name, test.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package metrics defines the Prometheus metrics muniverse
+// records for an environment fleet when
+// Options.MetricsRegisterer is set, so that users running
+// large training clusters can watch their envs in Grafana
+// instead of parsing Env.Log() strings after the fact.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "muniverse"
+
+var labelNames = []string{"env"}
+
+// A Set is the collection of metrics recorded for a single
+// Prometheus registerer. Every metric is labeled by env
+// (the EnvSpec name) only.
+//
+// container_id is deliberately not a label: every created
+// or restarted container (e.g. via muniverse/vec's
+// auto-restart) gets a fresh one, which would leave an
+// ever-growing, never-reclaimed set of time series in the
+// registry for exactly the "large training cluster" use
+// case this package targets.
+type Set struct {
+	StepDuration       *prometheus.HistogramVec
+	ResetDuration      *prometheus.HistogramVec
+	ObserveDuration    *prometheus.HistogramVec
+	ObservationBytes   *prometheus.HistogramVec
+	EpisodeReward      *prometheus.HistogramVec
+	EpisodeLength      *prometheus.HistogramVec
+	DevToolsReconnects *prometheus.CounterVec
+	ContainerRestarts  *prometheus.CounterVec
+	NotFoundErrors     *prometheus.CounterVec
+}
+
+// New creates a Set and registers its metrics with reg.
+//
+// Callers should create at most one Set per Registerer;
+// registering the same metric names twice panics. Package
+// muniverse handles this caching for Options.MetricsRegisterer
+// automatically.
+func New(reg prometheus.Registerer) *Set {
+	s := &Set{
+		StepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "step_duration_seconds",
+			Help:      "Time spent in a single Env.Step call.",
+			Buckets:   prometheus.DefBuckets,
+		}, labelNames),
+		ResetDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "reset_duration_seconds",
+			Help:      "Time spent in a single Env.Reset call.",
+			Buckets:   prometheus.DefBuckets,
+		}, labelNames),
+		ObserveDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "observe_duration_seconds",
+			Help:      "Time spent in a single Env.Observe call.",
+			Buckets:   prometheus.DefBuckets,
+		}, labelNames),
+		ObservationBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "observation_bytes",
+			Help:      "Size in bytes of encoded (JPEG or PNG) observations.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 2, 12),
+		}, labelNames),
+		EpisodeReward: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "episode_reward",
+			Help:      "Total reward accumulated over a completed episode.",
+			Buckets:   prometheus.DefBuckets,
+		}, labelNames),
+		EpisodeLength: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "episode_length_steps",
+			Help:      "Number of Step calls in a completed episode.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+		}, labelNames),
+		DevToolsReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "devtools_reconnects_total",
+			Help:      "Number of DevTools connection attempts beyond the first.",
+		}, labelNames),
+		ContainerRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "container_restarts_total",
+			Help:      "Number of times a crashed container was replaced.",
+		}, labelNames),
+		NotFoundErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "not_found_errors_total",
+			Help:      "Number of times Reset hit a 404 page instead of a game.",
+		}, labelNames),
+	}
+	reg.MustRegister(
+		s.StepDuration,
+		s.ResetDuration,
+		s.ObserveDuration,
+		s.ObservationBytes,
+		s.EpisodeReward,
+		s.EpisodeLength,
+		s.DevToolsReconnects,
+		s.ContainerRestarts,
+		s.NotFoundErrors,
+	)
+	return s
+}
+
+// Serve registers the standard Prometheus scrape handler
+// for gatherer at the "/metrics" path on mux.
+func Serve(mux *http.ServeMux, gatherer prometheus.Gatherer) {
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
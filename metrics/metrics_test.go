@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestLabelCardinality guards against re-introducing an
+// unbounded label like container_id, which would leave an
+// ever-growing set of time series for every restarted
+// container (see Set's doc comment).
+func TestLabelCardinality(t *testing.T) {
+	if !reflect.DeepEqual(labelNames, []string{"env"}) {
+		t.Errorf("expected labelNames to be exactly [\"env\"], got %v", labelNames)
+	}
+}
+
+func TestNewRegistersMetricsOnce(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	New(reg)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a second Set against the same Registerer to panic")
+		}
+	}()
+	New(reg)
+}
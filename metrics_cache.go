@@ -0,0 +1,40 @@
+package muniverse
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/unixpickle/muniverse/metrics"
+)
+
+// MetricsFor returns the same metrics.Set that
+// NewEnvOptions uses for reg, creating and registering it
+// the first time reg is seen.
+//
+// Other packages, such as muniverse/vec, that want to record
+// additional fleet-wide metrics (e.g. container restarts)
+// against a caller's Options.MetricsRegisterer should use
+// this instead of calling metrics.New directly, since
+// registering the same metric names twice panics.
+func MetricsFor(reg prometheus.Registerer) *metrics.Set {
+	return metricsFor(reg)
+}
+
+func metricsFor(reg prometheus.Registerer) *metrics.Set {
+	if reg == nil {
+		return nil
+	}
+	metricsCacheLock.Lock()
+	defer metricsCacheLock.Unlock()
+	if s, ok := metricsCache[reg]; ok {
+		return s
+	}
+	s := metrics.New(reg)
+	metricsCache[reg] = s
+	return s
+}
+
+var (
+	metricsCacheLock sync.Mutex
+	metricsCache     = map[prometheus.Registerer]*metrics.Set{}
+)
@@ -0,0 +1,340 @@
+// Package record wraps a muniverse.Env to capture each
+// episode as an MP4 video (for human viewing), a directory
+// of the original lossless PNG/JPEG observation bytes (one
+// file per step), and a JSONL trace of (t, events, reward,
+// done). Replay reads the frames and trace back, reproducing
+// exactly what the policy saw without a live Chrome, which
+// the lossy MP4 round-trip alone cannot guarantee.
+//
+// This is wired up via Options.Record: importing this
+// package for its side effect (an init function that calls
+// muniverse.RegisterRecorder) is enough to make that field
+// work.
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/muniverse"
+)
+
+func init() {
+	muniverse.RegisterRecorder(func(env muniverse.Env, cfg *muniverse.RecordConfig) (muniverse.Env, error) {
+		return New(env, cfg)
+	})
+}
+
+// A Recorder wraps a muniverse.Env, transparently capturing
+// a video and a trace file for every episode.
+//
+// Recorder implements muniverse.Env by embedding it, so a
+// Recorder can be used anywhere an Env is expected.
+type Recorder struct {
+	muniverse.Env
+	cfg *muniverse.RecordConfig
+
+	episode int
+	video   *videoWriter
+	frames  *frameWriter
+	trace   *traceWriter
+}
+
+// New wraps env so that each episode (each span between
+// Reset calls) is recorded to cfg.Dir.
+func New(env muniverse.Env, cfg *muniverse.RecordConfig) (*Recorder, error) {
+	if cfg.Dir == "" {
+		return nil, essentials.AddCtx("create recorder", fmt.Errorf("RecordConfig.Dir must be set"))
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, essentials.AddCtx("create recorder", err)
+	}
+	return &Recorder{Env: env, cfg: cfg, episode: -1}, nil
+}
+
+// Reset starts a new episode, finalizing the previous
+// episode's video and trace files if any.
+func (r *Recorder) Reset() (err error) {
+	if err := r.Env.Reset(); err != nil {
+		return err
+	}
+	if err := r.closeEpisode(); err != nil {
+		return err
+	}
+	r.episode++
+	r.video, err = newVideoWriter(r.cfg, r.episode)
+	if err != nil {
+		return err
+	}
+	r.frames, err = newFrameWriter(r.cfg, r.episode)
+	if err != nil {
+		return err
+	}
+	r.trace, err = newTraceWriter(r.cfg, r.episode)
+	if err != nil {
+		return err
+	}
+	// Capture the observation the policy will pick its first
+	// action from, so Replay can start from exactly what the
+	// policy saw rather than only from the frame after its
+	// first Step.
+	return r.recordFrame()
+}
+
+// Step behaves like the wrapped Env's Step, additionally
+// appending a trace entry and a video frame for this step.
+func (r *Recorder) Step(t time.Duration, events ...interface{}) (reward float64, done bool, err error) {
+	reward, done, err = r.Env.Step(t, events...)
+	if err != nil {
+		return
+	}
+	if r.trace != nil {
+		if err = r.trace.write(t, events, reward, done); err != nil {
+			return
+		}
+	}
+	err = r.recordFrame()
+	return
+}
+
+// recordFrame appends the current observation to the video
+// and frame files, if either is being recorded.
+func (r *Recorder) recordFrame() error {
+	if r.video == nil && r.frames == nil {
+		return nil
+	}
+	obs, err := r.Env.Observe()
+	if err != nil {
+		return err
+	}
+	if r.video != nil {
+		if err := r.video.writeFrame(obs); err != nil {
+			return err
+		}
+	}
+	if r.frames != nil {
+		if err := r.frames.writeFrame(obs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finalizes the current episode's files, then closes
+// the wrapped Env.
+func (r *Recorder) Close() error {
+	closeErr := r.closeEpisode()
+	if err := r.Env.Close(); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (r *Recorder) closeEpisode() error {
+	var err error
+	if r.trace != nil {
+		if e := r.trace.Close(); e != nil && err == nil {
+			err = e
+		}
+		r.trace = nil
+	}
+	if r.video != nil {
+		if e := r.video.Close(); e != nil && err == nil {
+			err = e
+		}
+		r.video = nil
+	}
+	if r.frames != nil {
+		if e := r.frames.Close(); e != nil && err == nil {
+			err = e
+		}
+		r.frames = nil
+	}
+	return err
+}
+
+func episodePath(cfg *muniverse.RecordConfig, episode int, ext string) string {
+	return filepath.Join(cfg.Dir, fmt.Sprintf("episode-%05d.%s", episode, ext))
+}
+
+// framesDir returns the directory that holds episode's raw,
+// losslessly-encoded per-step frames.
+func framesDir(cfg *muniverse.RecordConfig, episode int) string {
+	return filepath.Join(cfg.Dir, fmt.Sprintf("episode-%05d-frames", episode))
+}
+
+// traceWriter appends one JSON object per line, each
+// describing a single Step call.
+type traceWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+type traceEntry struct {
+	T      time.Duration `json:"t"`
+	Events []string      `json:"events"`
+	Reward float64       `json:"reward"`
+	Done   bool          `json:"done"`
+}
+
+func newTraceWriter(cfg *muniverse.RecordConfig, episode int) (*traceWriter, error) {
+	f, err := os.Create(episodePath(cfg, episode, "jsonl"))
+	if err != nil {
+		return nil, essentials.AddCtx("create trace file", err)
+	}
+	return &traceWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (t *traceWriter) write(d time.Duration, events []interface{}, reward float64, done bool) error {
+	strs := make([]string, len(events))
+	for i, e := range events {
+		strs[i] = fmt.Sprintf("%+v", e)
+	}
+	return t.enc.Encode(&traceEntry{T: d, Events: strs, Reward: reward, Done: done})
+}
+
+func (t *traceWriter) Close() error {
+	return t.f.Close()
+}
+
+// videoWriter pipes PNG-encoded frames into ffmpeg, which
+// re-encodes them into a single MP4.
+type videoWriter struct {
+	cmd   *exec.Cmd
+	stdin *bufio.Writer
+	pipe  io.Closer
+}
+
+func newVideoWriter(cfg *muniverse.RecordConfig, episode int) (*videoWriter, error) {
+	ffmpeg := cfg.FFmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	fps := cfg.FPS
+	if fps <= 0 {
+		fps = 30
+	}
+	cmd := exec.Command(ffmpeg,
+		"-y",
+		"-f", "image2pipe",
+		"-framerate", strconv.FormatFloat(fps, 'f', -1, 64),
+		"-i", "-",
+		"-pix_fmt", "yuv420p",
+		episodePath(cfg, episode, "mp4"),
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, essentials.AddCtx("start ffmpeg", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, essentials.AddCtx("start ffmpeg", err)
+	}
+	return &videoWriter{cmd: cmd, stdin: bufio.NewWriter(stdin), pipe: stdin}, nil
+}
+
+func (v *videoWriter) writeFrame(obs muniverse.Obs) error {
+	img, err := obsImage(obs)
+	if err != nil {
+		return err
+	}
+	return png.Encode(v.stdin, img)
+}
+
+// frameWriter saves each step's observation to its own
+// file, in whatever format the Env itself produced it, so
+// Replay can reproduce exactly what the policy saw instead
+// of relying on the lossy, chroma-subsampled MP4 the
+// videoWriter above writes for human viewing.
+type frameWriter struct {
+	dir   string
+	index int
+}
+
+func newFrameWriter(cfg *muniverse.RecordConfig, episode int) (*frameWriter, error) {
+	dir := framesDir(cfg, episode)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, essentials.AddCtx("create frames dir", err)
+	}
+	return &frameWriter{dir: dir}, nil
+}
+
+func (w *frameWriter) writeFrame(obs muniverse.Obs) error {
+	data, ext, err := encodedFrame(obs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(w.dir, fmt.Sprintf("frame-%05d.%s", w.index, ext))
+	w.index++
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (w *frameWriter) Close() error {
+	return nil
+}
+
+// encodedFrame returns obs's encoded bytes and a matching
+// file extension, re-encoding to PNG if obs does not
+// already carry its own encoded bytes (e.g. a custom Env's
+// image.Image observation).
+func encodedFrame(obs muniverse.Obs) (data []byte, ext string, err error) {
+	if data, format, ok := muniverse.EncodedImage(obs); ok {
+		if format == "jpeg" {
+			return data, "jpg", nil
+		}
+		return data, format, nil
+	}
+	img, err := obsImage(obs)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "png", nil
+}
+
+func (v *videoWriter) Close() error {
+	if err := v.stdin.Flush(); err != nil {
+		return err
+	}
+	if err := v.pipe.Close(); err != nil {
+		return err
+	}
+	return v.cmd.Wait()
+}
+
+// obsImage extracts an image.Image from obs. Real
+// muniverse observations are pre-encoded PNG or JPEG bytes,
+// decoded here via muniverse.EncodedImage; obs may also
+// directly implement image.Image, for callers wrapping a
+// custom Env.
+func obsImage(obs muniverse.Obs) (image.Image, error) {
+	if data, format, ok := muniverse.EncodedImage(obs); ok {
+		switch format {
+		case "png":
+			return png.Decode(bytes.NewReader(data))
+		case "jpeg":
+			return jpeg.Decode(bytes.NewReader(data))
+		default:
+			return nil, fmt.Errorf("record: unknown encoded image format %q", format)
+		}
+	}
+	if img, ok := obs.(image.Image); ok {
+		return img, nil
+	}
+	return nil, fmt.Errorf("record: observation of type %T cannot be captured as an image", obs)
+}
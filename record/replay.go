@@ -0,0 +1,159 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register the JPEG decoder with image.Decode
+	_ "image/png"  // register the PNG decoder with image.Decode
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/muniverse"
+)
+
+// A Replay reproduces the observations and rewards of a
+// recorded episode, for offline evaluation and debugging of
+// trained policies without a live Chrome instance.
+//
+// Replay does not implement muniverse.Env: recorded episodes
+// already have their events baked in, so there is nothing
+// for a caller to act on besides stepping forward.
+type Replay struct {
+	entries []traceEntry
+	frames  []image.Image
+	pos     int
+}
+
+// OpenReplay loads the frames and trace file written for the
+// given episode under cfg.Dir.
+//
+// Frames are read from the lossless per-step files the
+// Recorder wrote alongside the (lossy, human-viewing-only)
+// MP4, so the observations returned by Observe are exactly
+// what the recorded policy saw.
+func OpenReplay(cfg *muniverse.RecordConfig, episode int) (r *Replay, err error) {
+	defer essentials.AddCtxTo("open replay", &err)
+
+	entries, err := readTrace(episodePath(cfg, episode, "jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	frames, err := readFrames(framesDir(cfg, episode))
+	if err != nil {
+		return nil, err
+	}
+	// frames has one extra entry at index 0: the observation
+	// recorded right after Reset, before any Step was taken.
+	if len(frames) != len(entries)+1 {
+		return nil, fmt.Errorf("replay: %d frames but %d trace entries", len(frames), len(entries))
+	}
+
+	return &Replay{entries: entries, frames: frames}, nil
+}
+
+// Len returns the number of recorded steps.
+func (r *Replay) Len() int {
+	return len(r.entries)
+}
+
+// Reset rewinds the replay to the start of the episode.
+func (r *Replay) Reset() error {
+	r.pos = 0
+	return nil
+}
+
+// Step advances to the next recorded step, returning its
+// reward and done flag exactly as they were recorded.
+func (r *Replay) Step() (reward float64, done bool, err error) {
+	if r.pos >= len(r.entries) {
+		return 0, true, fmt.Errorf("replay: no more recorded steps")
+	}
+	entry := r.entries[r.pos]
+	r.pos++
+	return entry.Reward, entry.Done, nil
+}
+
+// Observe returns the frame for the current position: the
+// post-Reset observation before any Step call, or the frame
+// recorded for the most recent Step call otherwise.
+func (r *Replay) Observe() (image.Image, error) {
+	if r.pos < 0 || r.pos >= len(r.frames) {
+		return nil, fmt.Errorf("replay: no frame for current step")
+	}
+	return r.frames[r.pos], nil
+}
+
+func readTrace(path string) ([]traceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []traceEntry
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var e traceEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readFrames loads and decodes the per-step frame files
+// a Recorder wrote to dir, in step order.
+//
+// Names are sorted by their parsed frame-%05d index rather
+// than lexicographically: once an episode runs past 100000
+// steps, the extra digit in "frame-100000.png" would
+// otherwise sort it before "frame-99999.png".
+func readFrames(dir string) ([]image.Image, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "frame-*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return frameIndex(names[i]) < frameIndex(names[j])
+	})
+
+	frames := make([]image.Image, len(names))
+	for i, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = img
+	}
+	return frames, nil
+}
+
+// frameIndex parses the %05d step index out of a
+// "frame-%05d.<ext>" path written by frameWriter. A
+// malformed name (one readFrames' glob should never produce)
+// sorts last.
+func frameIndex(path string) int {
+	base := strings.TrimPrefix(filepath.Base(path), "frame-")
+	if dot := strings.IndexByte(base, '.'); dot >= 0 {
+		base = base[:dot]
+	}
+	n, err := strconv.Atoi(base)
+	if err != nil {
+		return int(^uint(0) >> 1)
+	}
+	return n
+}
@@ -0,0 +1,33 @@
+package muniverse
+
+// RecordConfig configures episode recording when set as
+// Options.Record. See the muniverse/record package for the
+// Recorder and Replay types that implement it.
+type RecordConfig struct {
+	// Dir is the directory under which one video, one
+	// directory of lossless per-step frames, and one JSONL
+	// trace file are written per episode.
+	Dir string
+
+	// FPS is the frame rate of the recorded video.
+	FPS float64
+
+	// FFmpegPath overrides the path to the ffmpeg binary
+	// used to encode video. If empty, "ffmpeg" is looked up
+	// on $PATH.
+	FFmpegPath string
+}
+
+// recorderHook is installed by muniverse/record's init
+// function, so that NewEnvOptions can wrap an Env with a
+// Recorder without this package importing muniverse/record,
+// which itself imports muniverse.
+var recorderHook func(Env, *RecordConfig) (Env, error)
+
+// RegisterRecorder installs the hook that Options.Record
+// uses to wrap a newly created Env. It is called from
+// muniverse/record's init function; importing that package
+// for its side effect is what enables Options.Record.
+func RegisterRecorder(hook func(Env, *RecordConfig) (Env, error)) {
+	recorderHook = hook
+}
@@ -0,0 +1,290 @@
+package runtime
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/unixpickle/essentials"
+)
+
+const (
+	containerdNamespace   = "muniverse"
+	containerdDefaultSock = "/run/containerd/containerd.sock"
+)
+
+// containerdRuntime runs containers by talking directly to
+// a containerd socket, for hosts (many Kubernetes nodes,
+// these days) that ship containerd but not Docker.
+//
+// Containers run in the host network namespace rather than
+// behind Docker-style NAT, since publishing per-container
+// ports requires a CNI plugin this package does not set up.
+// Chrome's fixed 9222/1337 ports are therefore reachable
+// directly on the host, which also means only one container
+// created by this backend may run at a time; see
+// containerdActiveGuard. Multi-environment batches (e.g.
+// muniverse/vec) should use RuntimeDocker instead.
+type containerdRuntime struct {
+	client *containerd.Client
+}
+
+func newContainerdRuntime(socket string) (Runtime, error) {
+	if socket == "" {
+		socket = containerdDefaultSock
+	}
+	client, err := containerd.New(socket)
+	if err != nil {
+		return nil, essentials.AddCtx("new containerd client", err)
+	}
+	return &containerdRuntime{client: client}, nil
+}
+
+func (c *containerdRuntime) ctx(ctx context.Context) context.Context {
+	return namespaces.WithNamespace(ctx, containerdNamespace)
+}
+
+func (c *containerdRuntime) EnsureImage(ctx context.Context, image string) (err error) {
+	defer essentials.AddCtxTo("pull image", &err)
+	_, err = c.client.Pull(c.ctx(ctx), image, containerd.WithPullUnpack)
+	return err
+}
+
+func (c *containerdRuntime) Create(ctx context.Context, spec *Spec) (h Handle, err error) {
+	defer essentials.AddCtxTo("containerd create", &err)
+
+	if err := containerdActiveGuard.acquire(); err != nil {
+		return "", err
+	}
+	defer func() {
+		// Released here only if Create fails; on success the
+		// hold lasts for the container's lifetime and Kill
+		// releases it.
+		if err != nil {
+			containerdActiveGuard.release()
+		}
+	}()
+
+	ctx = c.ctx(ctx)
+
+	if spec.Volume != "" || len(spec.ExtraVolumes) > 0 {
+		return "", fmt.Errorf("the containerd runtime does not yet support bind mounts")
+	}
+	if spec.Resources.GPUs != "" {
+		return "", fmt.Errorf("the containerd runtime does not yet support GPUs")
+	}
+	if len(spec.Resources.SecurityOpts) > 0 {
+		return "", fmt.Errorf("the containerd runtime does not yet support SecurityOpts")
+	}
+
+	image, err := c.client.Pull(ctx, spec.Image, containerd.WithPullUnpack)
+	if err != nil {
+		return "", err
+	}
+
+	id := newContainerID()
+	windowArg := fmt.Sprintf("--window-size=%d,%d", spec.WindowWidth, spec.WindowHeight)
+	specOpts := []oci.SpecOpts{
+		oci.WithImageConfig(image),
+		oci.WithProcessArgs(windowArg),
+		oci.WithHostNamespace(specs.NetworkNamespace),
+	}
+	specOpts = append(specOpts, resourceSpecOpts(spec.Resources)...)
+
+	container, err := c.client.NewContainer(ctx, id,
+		containerd.WithImage(image),
+		containerd.WithNewSnapshot(id+"-snapshot", image),
+		containerd.WithNewSpec(specOpts...),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	task, err := container.NewTask(ctx, cio.NullIO)
+	if err != nil {
+		container.Delete(ctx, containerd.WithSnapshotCleanup)
+		return "", err
+	}
+	if err := task.Start(ctx); err != nil {
+		task.Delete(ctx)
+		container.Delete(ctx, containerd.WithSnapshotCleanup)
+		return "", err
+	}
+
+	return Handle(id), nil
+}
+
+// resourceSpecOpts translates res into OCI spec options.
+// GPUs and SecurityOpts have no containerd-native equivalent
+// used here; Create rejects them outright rather than
+// silently ignoring them, so callers don't lose sandboxing or
+// GPU access without noticing.
+func resourceSpecOpts(res Resources) []oci.SpecOpts {
+	var opts []oci.SpecOpts
+	if res.CPUShares != 0 {
+		opts = append(opts, oci.WithCPUShares(uint64(res.CPUShares)))
+	}
+	if res.CPUQuota != 0 {
+		opts = append(opts, oci.WithCPUCFS(res.CPUQuota, defaultCFSPeriod))
+	}
+	if res.CPUSetCPUs != "" {
+		opts = append(opts, oci.WithCPUs(res.CPUSetCPUs))
+	}
+	if res.MemoryBytes != 0 {
+		opts = append(opts, oci.WithMemoryLimit(uint64(res.MemoryBytes)))
+	}
+	if res.MemorySwapBytes != 0 {
+		opts = append(opts, withMemorySwap(res.MemorySwapBytes))
+	}
+	if res.PidsLimit != 0 {
+		opts = append(opts, oci.WithPidsLimit(res.PidsLimit))
+	}
+	shmSize := res.ShmSizeBytes
+	if shmSize == 0 {
+		shmSize = defaultShmSizeBytes
+	}
+	opts = append(opts, withShmSize(shmSize))
+	return opts
+}
+
+const defaultShmSizeBytes = 200 * 1024 * 1024
+
+// defaultCFSPeriod is the standard Linux CFS scheduling period (100ms),
+// matching the implicit default the docker CLI driver relies on when
+// translating --cpu-quota without an explicit --cpu-period.
+const defaultCFSPeriod = 100000
+
+// withShmSize mounts a /dev/shm tmpfs sized at bytes,
+// mirroring the Docker backend's --shm-size default: Chrome
+// needs more than runc's tiny (64 MiB) default /dev/shm to
+// avoid crashing on large pages.
+func withShmSize(bytes int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		mount := specs.Mount{
+			Destination: "/dev/shm",
+			Type:        "tmpfs",
+			Source:      "shm",
+			Options: []string{
+				"nosuid", "noexec", "nodev",
+				"mode=1777",
+				fmt.Sprintf("size=%d", bytes),
+			},
+		}
+		for i, m := range s.Mounts {
+			if m.Destination == "/dev/shm" {
+				s.Mounts[i] = mount
+				return nil
+			}
+		}
+		s.Mounts = append(s.Mounts, mount)
+		return nil
+	}
+}
+
+// withMemorySwap sets the container's combined memory+swap
+// limit, as in `docker run --memory-swap`.
+func withMemorySwap(bytes int64) oci.SpecOpts {
+	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
+		if s.Linux == nil {
+			s.Linux = &specs.Linux{}
+		}
+		if s.Linux.Resources == nil {
+			s.Linux.Resources = &specs.LinuxResources{}
+		}
+		if s.Linux.Resources.Memory == nil {
+			s.Linux.Resources.Memory = &specs.LinuxMemory{}
+		}
+		s.Linux.Resources.Memory.Swap = &bytes
+		return nil
+	}
+}
+
+// newContainerID returns a random container ID, since
+// containerd (unlike Docker) requires the caller to name
+// each container.
+func newContainerID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return "muniverse-" + hex.EncodeToString(buf)
+}
+
+// Inspect always reports the fixed host ports, since
+// containers created by this Runtime run in the host
+// network namespace rather than behind Docker-style NAT.
+func (c *containerdRuntime) Inspect(ctx context.Context, h Handle) (Info, error) {
+	return Info{
+		Ports: map[string]string{
+			"9222/tcp": "9222",
+			"1337/tcp": "1337",
+		},
+		IPAddress: "localhost",
+	}, nil
+}
+
+func (c *containerdRuntime) Kill(ctx context.Context, h Handle) (err error) {
+	defer essentials.AddCtxTo("containerd kill", &err)
+	defer containerdActiveGuard.release()
+	ctx = c.ctx(ctx)
+
+	container, err := c.client.LoadContainer(ctx, string(h))
+	if err != nil {
+		return err
+	}
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return container.Delete(ctx, containerd.WithSnapshotCleanup)
+	}
+	if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+		return err
+	}
+	if _, err := task.Delete(ctx); err != nil {
+		return err
+	}
+	return container.Delete(ctx, containerd.WithSnapshotCleanup)
+}
+
+func (c *containerdRuntime) Close() error {
+	return c.client.Close()
+}
+
+// containerdActiveGuard enforces that at most one container
+// created by the containerd backend is running at a time,
+// since those containers share the host's network namespace
+// and would otherwise collide on Chrome's fixed 9222/1337
+// ports. Batched backends like muniverse/vec should reject
+// RuntimeContainerd for NumEnvs > 1 rather than relying on
+// this as their only signal.
+var containerdActiveGuard activeGuard
+
+type activeGuard struct {
+	lock   sync.Mutex
+	active bool
+}
+
+func (g *activeGuard) acquire() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.active {
+		return errors.New("the containerd runtime only supports one running environment " +
+			"per host at a time (its containers share the host network namespace); " +
+			"use RuntimeDocker for batches of more than one environment")
+	}
+	g.active = true
+	return nil
+}
+
+func (g *activeGuard) release() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.active = false
+}
@@ -0,0 +1,100 @@
+package runtime
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/containerd/oci"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func applySpecOpts(t *testing.T, opts []oci.SpecOpts) *oci.Spec {
+	s := &oci.Spec{Linux: &specs.Linux{}}
+	for _, opt := range opts {
+		if err := opt(context.Background(), nil, nil, s); err != nil {
+			t.Fatalf("unexpected error applying spec opt: %s", err)
+		}
+	}
+	return s
+}
+
+func TestResourceSpecOptsDefaultsShmSize(t *testing.T) {
+	s := applySpecOpts(t, resourceSpecOpts(Resources{}))
+	if len(s.Mounts) != 1 || s.Mounts[0].Destination != "/dev/shm" {
+		t.Fatalf("expected a default /dev/shm mount, got %+v", s.Mounts)
+	}
+	if want := "size=" + strconv.FormatInt(defaultShmSizeBytes, 10); !containsOption(s.Mounts[0].Options, want) {
+		t.Errorf("expected shm mount sized %s, got options %v", want, s.Mounts[0].Options)
+	}
+	if s.Linux.Resources != nil && s.Linux.Resources.CPU != nil {
+		t.Errorf("expected no CPU resources set when Resources is zero, got %+v", s.Linux.Resources.CPU)
+	}
+}
+
+func TestResourceSpecOptsTranslatesLimits(t *testing.T) {
+	res := Resources{
+		CPUShares:       512,
+		CPUQuota:        50000,
+		CPUSetCPUs:      "0-1",
+		MemoryBytes:     1 << 20,
+		MemorySwapBytes: 2 << 20,
+		PidsLimit:       64,
+		ShmSizeBytes:    1 << 10,
+	}
+	s := applySpecOpts(t, resourceSpecOpts(res))
+
+	cpu := s.Linux.Resources.CPU
+	if cpu == nil || cpu.Shares == nil || *cpu.Shares != uint64(res.CPUShares) {
+		t.Errorf("expected CPU shares %d, got %+v", res.CPUShares, cpu)
+	}
+	if cpu.Quota == nil || *cpu.Quota != res.CPUQuota {
+		t.Errorf("expected CPU quota %d, got %+v", res.CPUQuota, cpu.Quota)
+	}
+	if cpu.Period == nil || *cpu.Period != defaultCFSPeriod {
+		t.Errorf("expected CPU period %d, got %+v", defaultCFSPeriod, cpu.Period)
+	}
+	if cpu.Cpus != res.CPUSetCPUs {
+		t.Errorf("expected cpuset %q, got %q", res.CPUSetCPUs, cpu.Cpus)
+	}
+
+	mem := s.Linux.Resources.Memory
+	if mem == nil || mem.Limit == nil || *mem.Limit != res.MemoryBytes {
+		t.Errorf("expected memory limit %d, got %+v", res.MemoryBytes, mem)
+	}
+	if mem.Swap == nil || *mem.Swap != res.MemorySwapBytes {
+		t.Errorf("expected memory swap %d, got %+v", res.MemorySwapBytes, mem.Swap)
+	}
+
+	if s.Linux.Resources.Pids == nil || s.Linux.Resources.Pids.Limit != res.PidsLimit {
+		t.Errorf("expected pids limit %d, got %+v", res.PidsLimit, s.Linux.Resources.Pids)
+	}
+
+	if len(s.Mounts) != 1 || !containsOption(s.Mounts[0].Options, "size="+strconv.FormatInt(res.ShmSizeBytes, 10)) {
+		t.Errorf("expected shm mount sized %d, got %+v", res.ShmSizeBytes, s.Mounts)
+	}
+}
+
+func containsOption(opts []string, want string) bool {
+	for _, o := range opts {
+		if o == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestActiveGuardSerializesContainers(t *testing.T) {
+	var g activeGuard
+	if err := g.acquire(); err != nil {
+		t.Fatalf("unexpected error on first acquire: %s", err)
+	}
+	if err := g.acquire(); err == nil {
+		t.Error("expected a second acquire to fail while the first is still held")
+	}
+	g.release()
+	if err := g.acquire(); err != nil {
+		t.Errorf("expected acquire to succeed after release, got: %s", err)
+	}
+	g.release()
+}
@@ -0,0 +1,98 @@
+//go:build !dockercli
+// +build !dockercli
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	goruntime "runtime"
+
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/muniverse/dockerdriver"
+)
+
+// dockerRuntime runs containers through the Docker Engine
+// API (or a Docker-API-compatible daemon such as Podman).
+//
+// This is the default backend. Build with -tags dockercli
+// to fall back to shelling out to a CLI binary on hosts
+// where the API socket is not reachable.
+type dockerRuntime struct {
+	cli *dockerdriver.Client
+}
+
+func newDockerRuntime(socket string) (Runtime, error) {
+	cli, err := dockerdriver.NewClientAt(socket)
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{cli: cli}, nil
+}
+
+func (d *dockerRuntime) EnsureImage(ctx context.Context, image string) (err error) {
+	defer essentials.AddCtxTo("ensure image", &err)
+	return d.cli.EnsureImage(ctx, image, nil)
+}
+
+func (d *dockerRuntime) Create(ctx context.Context, spec *Spec) (h Handle, err error) {
+	defer essentials.AddCtxTo("docker run", &err)
+	id, err := d.cli.Run(ctx, &dockerdriver.RunSpec{
+		Image:        spec.Image,
+		Volume:       spec.Volume,
+		VolumeMode:   spec.VolumeMode,
+		ExtraVolumes: spec.ExtraVolumes,
+		WindowWidth:  spec.WindowWidth,
+		WindowHeight: spec.WindowHeight,
+		Resources: dockerdriver.Resources{
+			CPUShares:       spec.Resources.CPUShares,
+			CPUQuota:        spec.Resources.CPUQuota,
+			CPUSetCPUs:      spec.Resources.CPUSetCPUs,
+			MemoryBytes:     spec.Resources.MemoryBytes,
+			MemorySwapBytes: spec.Resources.MemorySwapBytes,
+			PidsLimit:       spec.Resources.PidsLimit,
+			ShmSizeBytes:    spec.Resources.ShmSizeBytes,
+			GPUs:            spec.Resources.GPUs,
+			SecurityOpts:    spec.Resources.SecurityOpts,
+		},
+	}, nil)
+	return Handle(id), err
+}
+
+func (d *dockerRuntime) Inspect(ctx context.Context, h Handle) (info Info, err error) {
+	defer essentials.AddCtxTo("docker inspect", &err)
+	ports, err := d.cli.Ports(ctx, string(h))
+	if err != nil {
+		return Info{}, err
+	}
+	addr, err := dockerIPAddress(ctx, d.cli, string(h))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Ports: ports, IPAddress: addr}, nil
+}
+
+func (d *dockerRuntime) Kill(ctx context.Context, h Handle) error {
+	return d.cli.Kill(ctx, string(h))
+}
+
+func (d *dockerRuntime) Close() error {
+	return d.cli.Close()
+}
+
+// dockerIPAddress returns the address to dial id's bound
+// ports on. Docker Desktop for Windows needs the container's
+// actual network address; everywhere else, Docker's port
+// forwarding makes "localhost" work.
+func dockerIPAddress(ctx context.Context, cli *dockerdriver.Client, id string) (string, error) {
+	if goruntime.GOOS != "windows" {
+		return "localhost", nil
+	}
+	for _, network := range []string{"bridge", "nat"} {
+		addr, err := cli.IPAddress(ctx, id, network)
+		if err == nil {
+			return addr, nil
+		}
+	}
+	return "", errors.New("unable to find container IP address")
+}
@@ -0,0 +1,220 @@
+//go:build dockercli
+// +build dockercli
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/unixpickle/essentials"
+)
+
+// This error message occurs very infrequently when doing
+// `docker run` on my machine running Ubuntu 16.04.1.
+const occasionalDockerErr = "Error response from daemon: device or resource busy."
+
+// dockerRuntime runs containers by shelling out to the
+// `docker` CLI binary.
+//
+// This is the legacy backend, kept for hosts where the
+// Docker Engine API socket is unreachable (e.g. remote
+// Docker contexts without a forwarded socket) but the CLI
+// itself still works. Build with -tags dockercli to use it.
+type dockerRuntime struct {
+	lock sync.Mutex
+}
+
+func newDockerRuntime(socket string) (Runtime, error) {
+	if socket != "" {
+		return nil, errors.New("RuntimeSocket is not supported when built with -tags dockercli")
+	}
+	return &dockerRuntime{}, nil
+}
+
+func (d *dockerRuntime) EnsureImage(ctx context.Context, image string) error {
+	_, err := d.command(ctx, "pull", image)
+	return err
+}
+
+func (d *dockerRuntime) Create(ctx context.Context, spec *Spec) (h Handle, err error) {
+	for i := 0; i < 3; i++ {
+		var id string
+		id, err = d.run(ctx, spec)
+		if err == nil || !strings.Contains(err.Error(), occasionalDockerErr) {
+			return Handle(id), err
+		}
+	}
+	return "", err
+}
+
+func (d *dockerRuntime) run(ctx context.Context, spec *Spec) (id string, err error) {
+	args := []string{
+		"run",
+		"-p",
+		portRange + ":9222",
+		"-p",
+		portRange + ":1337",
+		"-d",   // Run in detached mode.
+		"--rm", // Automatically delete the container.
+		"-i",   // Give netcat a stdin to read from.
+	}
+	args = append(args, resourceArgs(spec.Resources)...)
+	if spec.Volume != "" {
+		mount := spec.Volume + ":/downloaded_games"
+		if spec.VolumeMode != "" {
+			mount += ":" + spec.VolumeMode
+		}
+		args = append(args, "-v", mount)
+	}
+	for _, extra := range spec.ExtraVolumes {
+		args = append(args, "-v", extra)
+	}
+	args = append(args, spec.Image,
+		fmt.Sprintf("--window-size=%d,%d", spec.WindowWidth, spec.WindowHeight))
+
+	output, err := d.command(ctx, args...)
+	if err != nil {
+		return "", essentials.AddCtx("docker run",
+			fmt.Errorf("%s (make sure docker is up-to-date)", err))
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+const portRange = "9000-9999"
+
+// resourceArgs translates res into `docker run` flags,
+// defaulting --shm-size to 200m since Chrome needs more
+// than Docker's tiny default to avoid crashing on large
+// pages.
+func resourceArgs(res Resources) []string {
+	shmSize := "200m"
+	if res.ShmSizeBytes != 0 {
+		shmSize = strconv.FormatInt(res.ShmSizeBytes, 10) + "b"
+	}
+	args := []string{"--shm-size=" + shmSize}
+	if res.CPUShares != 0 {
+		args = append(args, "--cpu-shares="+strconv.FormatInt(res.CPUShares, 10))
+	}
+	if res.CPUQuota != 0 {
+		args = append(args, "--cpu-quota="+strconv.FormatInt(res.CPUQuota, 10))
+	}
+	if res.CPUSetCPUs != "" {
+		args = append(args, "--cpuset-cpus="+res.CPUSetCPUs)
+	}
+	if res.MemoryBytes != 0 {
+		args = append(args, "--memory="+strconv.FormatInt(res.MemoryBytes, 10)+"b")
+	}
+	if res.MemorySwapBytes != 0 {
+		args = append(args, "--memory-swap="+strconv.FormatInt(res.MemorySwapBytes, 10)+"b")
+	}
+	if res.PidsLimit != 0 {
+		args = append(args, "--pids-limit="+strconv.FormatInt(res.PidsLimit, 10))
+	}
+	if res.GPUs != "" {
+		args = append(args, "--gpus="+res.GPUs)
+	}
+	for _, secOpt := range res.SecurityOpts {
+		args = append(args, "--security-opt="+secOpt)
+	}
+	return args
+}
+
+func (d *dockerRuntime) Inspect(ctx context.Context, h Handle) (info Info, err error) {
+	defer essentials.AddCtxTo("docker inspect", &err)
+	ports, err := d.boundPorts(ctx, string(h))
+	if err != nil {
+		return Info{}, err
+	}
+	addr, err := d.ipAddress(ctx, string(h))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Ports: ports, IPAddress: addr}, nil
+}
+
+func (d *dockerRuntime) boundPorts(ctx context.Context,
+	containerID string) (mapping map[string]string, err error) {
+	defer essentials.AddCtxTo("docker inspect", &err)
+	rawJSON, err := d.command(ctx, "inspect", containerID)
+	if err != nil {
+		return nil, err
+	}
+	var info []struct {
+		NetworkSettings struct {
+			Ports map[string][]struct {
+				HostPort string
+			}
+		}
+	}
+	if err := json.Unmarshal(rawJSON, &info); err != nil {
+		return nil, err
+	}
+	if len(info) != 1 {
+		return nil, errors.New("unexpected number of results")
+	}
+	rawMapping := info[0].NetworkSettings.Ports
+	mapping = map[string]string{}
+	for containerPort, hostPorts := range rawMapping {
+		if len(hostPorts) != 1 {
+			return nil, errors.New("unexpected number of host ports")
+		}
+		mapping[containerPort] = hostPorts[0].HostPort
+	}
+	return
+}
+
+func (d *dockerRuntime) ipAddress(ctx context.Context, containerID string) (addr string, err error) {
+	if goruntime.GOOS != "windows" {
+		return "localhost", nil
+	}
+	defer essentials.AddCtxTo("docker inspect", &err)
+	for _, network := range []string{"bridge", "nat"} {
+		ipData, err := d.command(
+			ctx,
+			"inspect",
+			"--format",
+			"{{ .NetworkSettings.Networks."+network+".IPAddress }}",
+			containerID,
+		)
+		if err != nil {
+			return "", err
+		}
+		ipStr := strings.TrimSpace(string(ipData))
+		if ipStr == "<no value>" || ipStr == "" {
+			continue
+		}
+		return ipStr, nil
+	}
+	return "", errors.New("unable to find container IP address")
+}
+
+func (d *dockerRuntime) Kill(ctx context.Context, h Handle) error {
+	_, err := d.command(ctx, "kill", string(h))
+	return err
+}
+
+func (d *dockerRuntime) Close() error {
+	return nil
+}
+
+func (d *dockerRuntime) command(ctx context.Context, args ...string) (output []byte, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	output, err = exec.CommandContext(ctx, "docker", args...).Output()
+	if err != nil {
+		if eo, ok := err.(*exec.ExitError); ok && len(eo.Stderr) > 0 {
+			stderrMsg := strings.TrimSpace(string(eo.Stderr))
+			err = fmt.Errorf("%s: %s", eo.String(), stderrMsg)
+		}
+	}
+	return
+}
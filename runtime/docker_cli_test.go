@@ -0,0 +1,46 @@
+//go:build dockercli
+// +build dockercli
+
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResourceArgsDefaultsShmSize(t *testing.T) {
+	args := resourceArgs(Resources{})
+	want := []string{"--shm-size=200m"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected %v, got %v", want, args)
+	}
+}
+
+func TestResourceArgsTranslatesLimits(t *testing.T) {
+	res := Resources{
+		CPUShares:       512,
+		CPUQuota:        50000,
+		CPUSetCPUs:      "0-1",
+		MemoryBytes:     1 << 20,
+		MemorySwapBytes: 2 << 20,
+		PidsLimit:       64,
+		ShmSizeBytes:    1 << 10,
+		GPUs:            "all",
+		SecurityOpts:    []string{"seccomp=unconfined"},
+	}
+	want := []string{
+		"--shm-size=1024b",
+		"--cpu-shares=512",
+		"--cpu-quota=50000",
+		"--cpuset-cpus=0-1",
+		"--memory=1048576b",
+		"--memory-swap=2097152b",
+		"--pids-limit=64",
+		"--gpus=all",
+		"--security-opt=seccomp=unconfined",
+	}
+	args := resourceArgs(res)
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected %v, got %v", want, args)
+	}
+}
@@ -0,0 +1,134 @@
+// Package runtime abstracts the container engine that
+// muniverse sandboxes Chrome in, so that hosts without
+// Docker (many Kubernetes nodes now ship only containerd)
+// can still run muniverse environments.
+package runtime
+
+import (
+	"context"
+	"fmt"
+)
+
+// Kind selects which container engine backend a Runtime
+// talks to.
+type Kind int
+
+const (
+	// Docker talks to a Docker Engine API socket (the
+	// historical muniverse backend). Build with -tags
+	// dockercli to shell out to the `docker` CLI binary
+	// instead, for hosts where the API socket is
+	// unreachable but the CLI still works.
+	Docker Kind = iota
+
+	// Containerd talks directly to a containerd socket,
+	// bypassing Docker entirely.
+	Containerd
+
+	// Podman talks to a Podman socket using the same
+	// Docker-Engine-API-compatible client as Docker, since
+	// Podman exposes that API when run with `podman system
+	// service`.
+	Podman
+)
+
+// Spec describes the container that should be created for
+// a new environment.
+type Spec struct {
+	// Image is the container image to run.
+	Image string
+
+	// Volume, if non-empty, is a host directory to bind
+	// mount to /downloaded_games inside the container.
+	Volume string
+
+	// VolumeMode controls how Volume is mounted, e.g. the
+	// "ro", "z", or "Z" suffixes accepted by Docker.
+	// It may be empty for the default read/write mount.
+	VolumeMode string
+
+	// ExtraVolumes are additional host:container bind
+	// mounts (with an optional :mode suffix) to attach.
+	ExtraVolumes []string
+
+	// WindowWidth and WindowHeight are passed to the game
+	// server as the --window-size=W,H argument.
+	WindowWidth, WindowHeight int
+
+	// Resources caps what the container may consume.
+	Resources Resources
+}
+
+// Resources specifies optional resource limits for a
+// container. Zero values mean "no limit", except that a
+// zero ShmSizeBytes means the backend's default /dev/shm
+// size (200 MiB for the containerd and -tags dockercli
+// backends, Docker's own default for the Docker API backend).
+type Resources struct {
+	CPUShares       int64
+	CPUQuota        int64
+	CPUSetCPUs      string
+	MemoryBytes     int64
+	MemorySwapBytes int64
+	PidsLimit       int64
+	ShmSizeBytes    int64
+	GPUs            string
+	SecurityOpts    []string
+}
+
+// A Handle identifies a container created by a Runtime. Its
+// contents are backend-specific and should only be passed
+// back to the Runtime that created it.
+type Handle string
+
+// Info is what Inspect reports about a running container.
+type Info struct {
+	// Ports maps a container port (e.g. "9222/tcp") to the
+	// host port it is reachable on.
+	Ports map[string]string
+
+	// IPAddress is the host to dial Ports on, e.g.
+	// "localhost" or a container's address on a Windows
+	// NAT network.
+	IPAddress string
+}
+
+// A Runtime creates, inspects, and kills the containers
+// muniverse uses to sandbox Chrome.
+type Runtime interface {
+	// EnsureImage pulls image ahead of time if it is
+	// not already present, so that many Create calls
+	// against the same image don't race to pull it.
+	EnsureImage(ctx context.Context, image string) error
+
+	// Create starts a container for spec, pulling the image
+	// first if it is not already present.
+	Create(ctx context.Context, spec *Spec) (Handle, error)
+
+	// Inspect reports h's bound ports and the address they
+	// are reachable on.
+	Inspect(ctx context.Context, h Handle) (Info, error)
+
+	// Kill forcibly stops the container behind h.
+	Kill(ctx context.Context, h Handle) error
+
+	// Close releases resources held by the Runtime, such as
+	// its connection to the container engine. It does not
+	// stop any containers the Runtime created.
+	Close() error
+}
+
+// New returns the Runtime backend for kind, talking to
+// socket. An empty socket means the backend's usual default
+// (e.g. the DOCKER_HOST environment variable, or
+// /run/containerd/containerd.sock).
+func New(kind Kind, socket string) (Runtime, error) {
+	switch kind {
+	case Docker, Podman:
+		return newDockerRuntime(socket)
+	case Containerd:
+		return newContainerdRuntime(socket)
+	default:
+		return nil, fmt.Errorf("unknown runtime kind: %d", kind)
+	}
+}
@@ -0,0 +1,336 @@
+// Package vec batches several muniverse environments of
+// the same spec so that deep-RL algorithms like PPO and
+// IMPALA can step them in lockstep and gather observations
+// as one tensor, without every caller reinventing a pool of
+// Goroutines around muniverse.Env.
+package vec
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/muniverse"
+	"github.com/unixpickle/muniverse/metrics"
+)
+
+// A VecEnv steps a fixed-size batch of environments in
+// lockstep.
+//
+// It is not safe to run any methods on a VecEnv from more
+// than one Goroutine at a time, mirroring muniverse.Env.
+//
+// The lifecycle matches muniverse.Env: call Reset to start
+// an episode in every sub-environment, then call StepAsync
+// followed by StepWait repeatedly. Observe may be called any
+// time there is no pending StepAsync/StepWait round, i.e.
+// never in between the two. Call Close when done with the
+// VecEnv.
+//
+// If AutoReset is disabled, a sub-environment whose episode
+// ends stays done until the caller resets it with ResetIndex
+// (or resets the whole batch with Reset); stepOne never
+// restarts a sub-environment's container just because its
+// episode ended.
+type VecEnv struct {
+	spec *muniverse.EnvSpec
+	opts *muniverse.Options
+
+	stepDuration time.Duration
+	autoReset    bool
+
+	envs []muniverse.Env
+
+	// needsReset tracks, per sub-environment, whether its
+	// episode has ended and it is waiting for a Reset (or
+	// ResetIndex) call. It lets stepOne tell that expected
+	// state apart from a container actually dying.
+	needsReset []bool
+
+	metrics *metrics.Set
+
+	pending *pendingStep
+}
+
+// Options configures a VecEnv.
+type Options struct {
+	// NumEnvs is the number of sub-environments to run.
+	NumEnvs int
+
+	// StepDuration is the amount of simulated time each
+	// StepAsync/StepWait round advances every sub-environment
+	// by, as with the t argument to muniverse.Env.Step.
+	StepDuration time.Duration
+
+	// AutoReset, if set, transparently calls Reset on any
+	// sub-environment whose Step reports done=true, so that
+	// training loops never have to special-case episode
+	// boundaries or stall waiting for a manual Reset.
+	AutoReset bool
+}
+
+// New creates a VecEnv of vopts.NumEnvs sub-environments,
+// each running spec with the given per-environment opts.
+//
+// The Docker image is pulled once up front (see
+// muniverse.PrewarmImage) so that the sub-environments don't
+// race each other to pull it.
+func New(spec *muniverse.EnvSpec, opts *muniverse.Options, vopts *Options) (v *VecEnv, err error) {
+	defer essentials.AddCtxTo("create vec env", &err)
+
+	if vopts.NumEnvs < 1 {
+		return nil, errors.New("NumEnvs must be at least 1")
+	}
+	if vopts.NumEnvs > 1 && opts.Runtime == muniverse.RuntimeContainerd {
+		return nil, errors.New("RuntimeContainerd supports only one environment per host " +
+			"(its containers share the host network namespace); use RuntimeDocker for NumEnvs > 1")
+	}
+
+	if err := muniverse.PrewarmImage(opts); err != nil {
+		return nil, err
+	}
+
+	envs := make([]muniverse.Env, 0, vopts.NumEnvs)
+	for len(envs) < vopts.NumEnvs {
+		e, err := muniverse.NewEnvOptions(spec, opts)
+		if err != nil {
+			for _, created := range envs {
+				created.Close()
+			}
+			return nil, err
+		}
+		envs = append(envs, e)
+	}
+
+	return &VecEnv{
+		spec:         spec,
+		opts:         opts,
+		stepDuration: vopts.StepDuration,
+		autoReset:    vopts.AutoReset,
+		envs:         envs,
+		needsReset:   make([]bool, len(envs)),
+		metrics:      muniverse.MetricsFor(opts.MetricsRegisterer),
+	}, nil
+}
+
+// Len returns the number of sub-environments.
+func (v *VecEnv) Len() int {
+	return len(v.envs)
+}
+
+// Reset resets every sub-environment, restarting any whose
+// container has died in the meantime.
+func (v *VecEnv) Reset() error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(v.envs))
+	for i := range v.envs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := v.envs[i].Reset(); err != nil {
+				errs[i] = v.restart(i)
+			} else {
+				v.needsReset[i] = false
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("reset env %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// ResetIndex resets a single sub-environment, restarting its
+// container if it has died in the meantime.
+//
+// It lets a caller running with AutoReset disabled clear the
+// needs-reset state stepOne sets once that sub-environment's
+// episode ends, without resetting (and so discarding the
+// in-progress episodes of) every other sub-environment via
+// Reset.
+func (v *VecEnv) ResetIndex(i int) error {
+	if err := v.envs[i].Reset(); err != nil {
+		return v.restart(i)
+	}
+	v.needsReset[i] = false
+	return nil
+}
+
+// StepAsync begins stepping every sub-environment with the
+// given per-environment events, without blocking for the
+// results. Call StepWait to collect them.
+//
+// actions must have exactly Len() entries; actions[i] is
+// passed as the events for sub-environment i, typically
+// *chrome.MouseEvent or *chrome.KeyEvent values.
+func (v *VecEnv) StepAsync(actions [][]interface{}) error {
+	if v.pending != nil {
+		return errors.New("StepAsync called before a previous StepWait")
+	}
+	if len(actions) != len(v.envs) {
+		return fmt.Errorf("expected %d action lists but got %d", len(v.envs), len(actions))
+	}
+
+	results := make([]stepResult, len(v.envs))
+	var wg sync.WaitGroup
+	for i := range v.envs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = v.stepOne(i, actions[i])
+		}(i)
+	}
+	v.pending = &pendingStep{wg: &wg, results: results}
+	return nil
+}
+
+// StepWait blocks until the StepAsync call that started this
+// round completes, then returns the reward and done flag
+// from each sub-environment.
+//
+// If a sub-environment's container died, StepWait
+// transparently restarts it and reports that environment's
+// episode as done, rather than stalling or failing the whole
+// batch; index ordering is preserved. StepWait only returns
+// an error if a restart itself fails.
+func (v *VecEnv) StepWait() (rewards []float64, dones []bool, err error) {
+	if v.pending == nil {
+		return nil, nil, errors.New("StepWait called without a matching StepAsync")
+	}
+	v.pending.wg.Wait()
+	results := v.pending.results
+	v.pending = nil
+
+	rewards = make([]float64, len(results))
+	dones = make([]bool, len(results))
+	for i, res := range results {
+		if res.err != nil {
+			return nil, nil, fmt.Errorf("step env %d: %s", i, res.err)
+		}
+		rewards[i] = res.reward
+		dones[i] = res.done
+	}
+	return rewards, dones, nil
+}
+
+// Observe gathers an observation from every sub-environment.
+//
+// Observe must not be called while a StepAsync round is
+// pending (i.e. before the matching StepWait), since the
+// background Goroutines from StepAsync are still calling
+// Step on the same sub-environments.
+func (v *VecEnv) Observe() ([]muniverse.Obs, error) {
+	if v.pending != nil {
+		return nil, errors.New("Observe called before a pending StepAsync's StepWait")
+	}
+
+	obs := make([]muniverse.Obs, len(v.envs))
+	errs := make([]error, len(v.envs))
+	var wg sync.WaitGroup
+	for i := range v.envs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			obs[i], errs[i] = v.envs[i].Observe()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("observe env %d: %s", i, err)
+		}
+	}
+	return obs, nil
+}
+
+// Close closes every sub-environment.
+func (v *VecEnv) Close() error {
+	var firstErr error
+	for _, e := range v.envs {
+		if err := e.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type stepResult struct {
+	reward float64
+	done   bool
+	err    error
+}
+
+type pendingStep struct {
+	wg      *sync.WaitGroup
+	results []stepResult
+}
+
+func (v *VecEnv) stepOne(i int, events []interface{}) stepResult {
+	// With AutoReset disabled, a previous round already
+	// reported this sub-environment as done; stepping it
+	// again would just hit muniverse.ErrNeedsReset, so report
+	// the same done result without bothering the container.
+	if v.needsReset[i] {
+		return stepResult{done: true}
+	}
+
+	reward, done, err := v.envs[i].Step(v.stepDuration, events...)
+	if err != nil {
+		if muniverse.IsNeedsReset(err) {
+			// The sub-environment's episode ended on a
+			// previous round and nobody has reset it yet;
+			// this is expected bookkeeping, not a crash, so
+			// don't restart the container over it.
+			v.needsReset[i] = true
+			return stepResult{done: true}
+		}
+		if rerr := v.restart(i); rerr != nil {
+			return stepResult{err: fmt.Errorf("%s (restart failed: %s)", err, rerr)}
+		}
+		// Treat the crash itself as an episode boundary so
+		// callers can resume training without special-casing
+		// dead containers.
+		return stepResult{done: true}
+	}
+	if done {
+		if v.autoReset {
+			if rerr := v.envs[i].Reset(); rerr != nil {
+				if rerr2 := v.restart(i); rerr2 != nil {
+					return stepResult{err: fmt.Errorf("%s (restart failed: %s)", rerr, rerr2)}
+				}
+			}
+		} else {
+			v.needsReset[i] = true
+		}
+	}
+	return stepResult{reward: reward, done: done}
+}
+
+// restart replaces the sub-environment at index i with a
+// freshly created one, preserving i so callers never see the
+// batch re-ordered.
+func (v *VecEnv) restart(i int) error {
+	v.envs[i].Close()
+	e, err := muniverse.NewEnvOptions(v.spec, v.opts)
+	if err != nil {
+		return err
+	}
+	if err := e.Reset(); err != nil {
+		e.Close()
+		return err
+	}
+	if v.metrics != nil {
+		v.metrics.ContainerRestarts.With(prometheus.Labels{
+			"env": v.spec.Name,
+		}).Inc()
+	}
+	v.envs[i] = e
+	v.needsReset[i] = false
+	return nil
+}
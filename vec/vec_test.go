@@ -0,0 +1,233 @@
+package vec
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/muniverse"
+)
+
+// fakeEnv is a muniverse.Env that never touches Docker, so
+// VecEnv's bookkeeping (index ordering, restart-on-error,
+// auto-reset) can be tested without a running container.
+type fakeEnv struct {
+	spec *muniverse.EnvSpec
+
+	stepErr  error
+	resetErr error
+	reward   float64
+	done     bool
+	steps    int
+	resets   int
+	closed   bool
+}
+
+func (f *fakeEnv) Spec() *muniverse.EnvSpec { return f.spec }
+
+func (f *fakeEnv) Reset() error {
+	f.resets++
+	if f.resetErr != nil {
+		return f.resetErr
+	}
+	f.done = false
+	return nil
+}
+
+func (f *fakeEnv) Step(t time.Duration, events ...interface{}) (float64, bool, error) {
+	f.steps++
+	if f.stepErr != nil {
+		return 0, false, f.stepErr
+	}
+	return f.reward, f.done, nil
+}
+
+func (f *fakeEnv) Observe() (muniverse.Obs, error) { return nil, nil }
+
+func (f *fakeEnv) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *fakeEnv) Log() []string { return nil }
+
+func newTestVecEnv(envs ...*fakeEnv) *VecEnv {
+	wrapped := make([]muniverse.Env, len(envs))
+	for i, e := range envs {
+		wrapped[i] = e
+	}
+	return &VecEnv{envs: wrapped, needsReset: make([]bool, len(wrapped))}
+}
+
+func TestStepAsyncStepWaitPreservesOrder(t *testing.T) {
+	envs := []*fakeEnv{
+		{reward: 1},
+		{reward: 2, done: true},
+		{reward: 3},
+	}
+	v := newTestVecEnv(envs...)
+
+	if err := v.StepAsync(make([][]interface{}, 3)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rewards, dones, err := v.StepWait()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !(rewards[0] == 1 && rewards[1] == 2 && rewards[2] == 3) {
+		t.Errorf("rewards out of order: %v", rewards)
+	}
+	if !(dones[0] == false && dones[1] == true && dones[2] == false) {
+		t.Errorf("dones out of order: %v", dones)
+	}
+}
+
+func TestStepAsyncWrongActionCount(t *testing.T) {
+	v := newTestVecEnv(&fakeEnv{}, &fakeEnv{})
+	if err := v.StepAsync(make([][]interface{}, 1)); err == nil {
+		t.Error("expected an error for a mismatched action count")
+	}
+}
+
+func TestObserveRejectsPendingRound(t *testing.T) {
+	v := newTestVecEnv(&fakeEnv{}, &fakeEnv{})
+	if err := v.StepAsync(make([][]interface{}, 2)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := v.Observe(); err == nil {
+		t.Error("expected Observe to reject a pending StepAsync round")
+	}
+	if _, _, err := v.StepWait(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := v.Observe(); err != nil {
+		t.Errorf("expected Observe to succeed once the round is no longer pending: %s", err)
+	}
+}
+
+func TestStepOneAutoReset(t *testing.T) {
+	envs := []*fakeEnv{{done: true}}
+	v := newTestVecEnv(envs...)
+	v.autoReset = true
+
+	res := v.stepOne(0, nil)
+	if res.err != nil {
+		t.Fatalf("unexpected error: %s", res.err)
+	}
+	if !res.done {
+		t.Error("expected the step result to still report done")
+	}
+	if envs[0].resets != 1 {
+		t.Errorf("expected AutoReset to call Reset once, got %d calls", envs[0].resets)
+	}
+}
+
+func TestStepOneNeedsResetDoesNotRestart(t *testing.T) {
+	envs := []*fakeEnv{{done: true}}
+	v := newTestVecEnv(envs...)
+
+	// First round: the episode ends and, with AutoReset off,
+	// the sub-env is marked as needing a reset.
+	res := v.stepOne(0, nil)
+	if res.err != nil || !res.done {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// Second round: stepOne must not call Step again (which
+	// would return muniverse.ErrNeedsReset) or restart the
+	// container; it should just report done again.
+	res = v.stepOne(0, nil)
+	if res.err != nil {
+		t.Fatalf("unexpected error: %s", res.err)
+	}
+	if !res.done {
+		t.Error("expected the step result to still report done")
+	}
+	if envs[0].steps != 1 {
+		t.Errorf("expected Step to be called once, got %d calls", envs[0].steps)
+	}
+	if envs[0].closed {
+		t.Error("needing a reset should not restart the container")
+	}
+}
+
+func TestStepOneDoesNotRestartOnErrNeedsReset(t *testing.T) {
+	envs := []*fakeEnv{{stepErr: muniverse.ErrNeedsReset}}
+	v := newTestVecEnv(envs...)
+
+	res := v.stepOne(0, nil)
+	if res.err != nil {
+		t.Fatalf("unexpected error: %s", res.err)
+	}
+	if !res.done {
+		t.Error("expected the step result to report done")
+	}
+	if envs[0].closed {
+		t.Error("ErrNeedsReset should not be mistaken for a crash and trigger a restart")
+	}
+}
+
+func TestResetIndexClearsNeedsReset(t *testing.T) {
+	envs := []*fakeEnv{{done: true}}
+	v := newTestVecEnv(envs...)
+
+	v.stepOne(0, nil)
+	if err := v.ResetIndex(0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if envs[0].resets != 1 {
+		t.Errorf("expected ResetIndex to call Reset once, got %d calls", envs[0].resets)
+	}
+
+	res := v.stepOne(0, nil)
+	if envs[0].steps != 2 {
+		t.Errorf("expected Step to be called again after ResetIndex, got %d calls", envs[0].steps)
+	}
+	if res.done {
+		t.Error("expected a fresh episode to report done=false")
+	}
+}
+
+func TestStepOneRestartsOnError(t *testing.T) {
+	envs := []*fakeEnv{{stepErr: errors.New("container died")}}
+	v := newTestVecEnv(envs...)
+
+	// restart calls muniverse.NewEnvOptions, which dials
+	// Docker, so avoid that by setting DevtoolsHost without
+	// GameHost, which NewEnvOptions rejects up front. The test
+	// then asserts that the dead env was closed and that
+	// restart's failure surfaces as the step's error.
+	v.spec = &muniverse.EnvSpec{}
+	v.opts = &muniverse.Options{DevtoolsHost: "unreachable"}
+
+	res := v.stepOne(0, nil)
+	if !envs[0].closed {
+		t.Error("expected the crashed env to be closed")
+	}
+	if res.err == nil {
+		t.Error("expected restart to fail against an unreachable DevtoolsHost, surfacing an error")
+	}
+}
+
+func TestStepOneRestartsOnFailedAutoReset(t *testing.T) {
+	envs := []*fakeEnv{{done: true, resetErr: errors.New("reset failed")}}
+	v := newTestVecEnv(envs...)
+	v.autoReset = true
+
+	// restart calls muniverse.NewEnvOptions, which dials
+	// Docker, so stub it out the same way
+	// TestStepOneRestartsOnError does: assert the failed
+	// auto-reset is treated like a crash (the dead env is
+	// closed and restart's own failure surfaces), instead of
+	// returning Reset's error straight through.
+	v.spec = &muniverse.EnvSpec{}
+	v.opts = &muniverse.Options{DevtoolsHost: "unreachable"}
+
+	res := v.stepOne(0, nil)
+	if !envs[0].closed {
+		t.Error("expected the env whose auto-reset failed to be closed")
+	}
+	if res.err == nil {
+		t.Error("expected restart to fail against an unreachable DevtoolsHost, surfacing an error")
+	}
+}
@@ -0,0 +1,75 @@
+package muniverse
+
+import (
+	"errors"
+	"strings"
+)
+
+// GamesDirMode controls how Options.GamesDir is bind
+// mounted into the container, including whether it is
+// relabeled for SELinux.
+//
+// On SELinux-enforcing hosts (RHEL, Fedora, CoreOS), a bind
+// mount without a relabel causes Chrome inside the
+// container to get permission-denied errors when serving
+// games from GamesDir.
+type GamesDirMode int
+
+const (
+	// MountNone mounts GamesDir with Docker's default
+	// behavior and performs no SELinux relabeling.
+	MountNone GamesDirMode = iota
+
+	// MountPrivate relabels GamesDir so that only this
+	// container can access it (the `:Z` suffix).
+	MountPrivate
+
+	// MountShared relabels GamesDir so that it may be
+	// shared with other containers (the `:z` suffix).
+	MountShared
+
+	// MountReadOnly mounts GamesDir read-only and relabels
+	// it for exclusive use by this container (the
+	// `:ro,Z` suffix).
+	MountReadOnly
+)
+
+// dockerVolumeSuffix returns the bind mount option segment
+// (without the leading colon) for m, or "" for
+// MountNone.
+func (m GamesDirMode) dockerVolumeSuffix() string {
+	switch m {
+	case MountPrivate:
+		return "Z"
+	case MountShared:
+		return "z"
+	case MountReadOnly:
+		return "ro,Z"
+	default:
+		return ""
+	}
+}
+
+// validateHostPath checks that a bare host directory (as
+// opposed to a full "host:container[:opts]" volume spec)
+// does not itself contain a colon, which on most platforms
+// indicates the caller accidentally passed a full volume
+// spec instead of just a path.
+func validateHostPath(path string) error {
+	if strings.Contains(path, ":") {
+		return errors.New("path contains colons: " + path)
+	}
+	return nil
+}
+
+// validateExtraVolume checks a "host:container[:opts]"
+// volume spec as accepted by `docker run -v`, allowing the
+// trailing options segment (e.g. "ro", "z", "ro,Z") that
+// validateHostPath would otherwise reject.
+func validateExtraVolume(vol string) error {
+	parts := strings.Split(vol, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return errors.New("invalid volume spec: " + vol)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package muniverse
+
+import "testing"
+
+func TestGamesDirModeDockerVolumeSuffix(t *testing.T) {
+	tests := []struct {
+		mode GamesDirMode
+		want string
+	}{
+		{MountNone, ""},
+		{MountPrivate, "Z"},
+		{MountShared, "z"},
+		{MountReadOnly, "ro,Z"},
+	}
+	for _, test := range tests {
+		if actual := test.mode.dockerVolumeSuffix(); actual != test.want {
+			t.Errorf("mode %d: expected %q but got %q", test.mode, test.want, actual)
+		}
+	}
+}
+
+func TestValidateExtraVolume(t *testing.T) {
+	tests := []struct {
+		vol     string
+		wantErr bool
+	}{
+		{"/host/path:/container/path", false},
+		{"/host/path:/container/path:ro", false},
+		{"/host/path:/container/path:ro,Z", false},
+		{"/host/path", true},
+		{"/host/path:/container/path:ro:extra", true},
+	}
+	for _, test := range tests {
+		err := validateExtraVolume(test.vol)
+		if (err != nil) != test.wantErr {
+			t.Errorf("vol %q: expected error=%v but got %v", test.vol, test.wantErr, err)
+		}
+	}
+}